@@ -0,0 +1,140 @@
+/*
+Copyright © 2021 FairwindsOps
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+	"k8s.io/klog/v2"
+
+	"github.com/fairwindsops/vault-token-injector/pkg/app"
+)
+
+// loadConfig reads and merges the config files and returns the config and the
+// files it was loaded from
+func loadConfig() (*app.Config, []string, error) {
+	files, err := app.LoadConfigFiles(cfgFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	v := viper.New()
+	if err := v.MergeConfigMap(files.Settings); err != nil {
+		return nil, nil, err
+	}
+	config := &app.Config{}
+	if err := v.Unmarshal(config); err != nil {
+		return nil, nil, err
+	}
+	return config, files.Files, nil
+}
+
+// reloadOnChange watches the directories of the config files and reloads the app
+// when a config file in them changes, until the context is done. Watching the
+// directories rather than the files picks up new files, and ConfigMap mounts,
+// which are updated by swapping a symlink. An invalid config is logged and the
+// current config is kept.
+func reloadOnChange(ctx context.Context, a *app.App, files []string) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		klog.Errorf("could not watch the config for changes: %s", err.Error())
+		return
+	}
+	watched := map[string]bool{}
+	watch := func(files []string) {
+		for _, dir := range configDirs(files) {
+			if watched[dir] {
+				continue
+			}
+			if err := watcher.Add(dir); err != nil {
+				klog.Errorf("could not watch %s for config changes: %s", dir, err.Error())
+				continue
+			}
+			watched[dir] = true
+		}
+	}
+	watch(files)
+
+	go func() {
+		defer watcher.Close()
+		var reload <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !isConfigChange(event) {
+					continue
+				}
+				klog.V(3).Infof("config changed: %s", event.String())
+				// Wait for a burst of changes, such as an editor saving a file, to settle
+				reload = time.After(time.Second)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				klog.Errorf("error watching the config for changes: %s", err.Error())
+			case <-reload:
+				reload = nil
+				klog.Info("config changed, reloading")
+				config, files, err := loadConfig()
+				if err == nil {
+					err = a.Reload(config, files...)
+				}
+				if err != nil {
+					klog.Errorf("not reloading the config, keeping the current config: %s", err.Error())
+					continue
+				}
+				watch(files)
+			}
+		}
+	}()
+}
+
+// configDirs returns the directories to watch for changes to the config
+func configDirs(files []string) []string {
+	dirs := make([]string, 0, len(files)+1)
+	for _, file := range files {
+		dirs = append(dirs, filepath.Dir(file))
+	}
+	// A directory or glob can gain files that were not loaded before
+	if strings.ContainsAny(cfgFile, "*?[") {
+		if dir := filepath.Dir(cfgFile); !strings.ContainsAny(dir, "*?[") {
+			dirs = append(dirs, dir)
+		}
+	} else if info, err := os.Stat(cfgFile); err == nil && info.IsDir() {
+		dirs = append(dirs, filepath.Clean(cfgFile))
+	}
+	return dirs
+}
+
+// isConfigChange returns true if the event could be a change to a config file. Kubernetes
+// updates ConfigMap mounts by replacing the ..data symlink
+func isConfigChange(event fsnotify.Event) bool {
+	if event.Op == fsnotify.Chmod {
+		return false
+	}
+	ext := filepath.Ext(event.Name)
+	return ext == ".yaml" || ext == ".yml" || filepath.Base(event.Name) == "..data"
+}
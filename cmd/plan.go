@@ -0,0 +1,44 @@
+/*
+Copyright © 2021 FairwindsOps
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(planCmd)
+}
+
+var planCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "Prints what would be injected into each target.",
+	Long: `Authenticates to vault and checks that each target exists and is readable, then prints
+the variables that would be set and the vault role and policies that would be used. No tokens
+are created and nothing is written. Exits non-zero if any target has a problem.`,
+	RunE: plan,
+}
+
+func plan(cmd *cobra.Command, args []string) error {
+	enableMetrics = false
+	app, _, err := newApp()
+	if err != nil {
+		return err
+	}
+	return app.Plan(cmd.Context(), os.Stdout)
+}
@@ -19,6 +19,8 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
@@ -26,6 +28,8 @@ import (
 	"k8s.io/klog/v2"
 
 	"github.com/fairwindsops/vault-token-injector/pkg/app"
+	"github.com/fairwindsops/vault-token-injector/pkg/github"
+	"github.com/fairwindsops/vault-token-injector/pkg/gitlab"
 	"github.com/fairwindsops/vault-token-injector/pkg/spacelift"
 )
 
@@ -36,30 +40,54 @@ var (
 	vaultTokenFile  string
 	enableMetrics   bool
 	runOnce         bool
+	dryRun          bool
+	watchConfig     bool
 	spaceliftClient = &spacelift.Client{}
+	githubClient    = &github.Client{}
+	gitlabClient    = &gitlab.Client{}
 )
 
 var rootCmd = &cobra.Command{
 	Use:   "vault-token-injector",
 	Short: "Inject vault tokens into other things",
 	Long: `vault-token-injector will generate a new vault token given a vault role
-and populate that token into environment variables used by other tools such as CircleCI, Terraform Cloud, or Spacelift`,
+and populate that token into environment variables used by other tools such as CircleCI, Terraform Cloud, Spacelift, GitHub Actions, or GitLab CI`,
 	RunE: run,
 }
 
 func run(cmd *cobra.Command, args []string) error {
-	config := &app.Config{}
-	err := viper.Unmarshal(config)
+	if dryRun {
+		return plan(cmd, args)
+	}
+	app, files, err := newApp()
 	if err != nil {
 		return err
 	}
-	app := app.NewApp(circleToken, vaultTokenFile, tfCloudToken, config, enableMetrics, spaceliftClient)
+	ctx, stop := signal.NotifyContext(cmd.Context(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
 	if runOnce {
 		app.EnableMetrics = false
-		return app.RunOnce()
+		return app.RunOnce(ctx)
+	}
+	if watchConfig {
+		reloadOnChange(ctx, app, files)
+	}
+	return app.Run(ctx)
+}
+
+// newApp creates the app from the config files and flags, and validates the config.
+// It also returns the files the config was loaded from.
+func newApp() (*app.App, []string, error) {
+	config, files, err := loadConfig()
+	if err != nil {
+		return nil, nil, err
 	}
-	return app.Run()
+	a := app.NewApp(circleToken, vaultTokenFile, tfCloudToken, config, enableMetrics, spaceliftClient, githubClient, gitlabClient)
+	if err := a.Validate(files...); err != nil {
+		return nil, nil, err
+	}
+	return a, files, nil
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -73,15 +101,21 @@ func Execute(VERSION string, COMMIT string) {
 func init() {
 	cobra.OnInitialize(initConfig)
 
-	rootCmd.Flags().StringVarP(&cfgFile, "config", "c", "", "config file (default is .vault-token-injector.yaml in the current directory)")
-	rootCmd.Flags().StringVar(&circleToken, "circle-token", "", "A circleci token.")
-	rootCmd.Flags().StringVar(&tfCloudToken, "tfcloud-token", "", "A token for TFCloud access.")
-	rootCmd.Flags().StringVar(&vaultTokenFile, "vault-token-file", "", "A file that contains a vault token. Optional - can set VAULT_TOKEN directly if preferred.")
-	rootCmd.Flags().StringVar(&spaceliftClient.URL, "spacelift-url", "", "The URL of the spacelift instance.")
-	rootCmd.Flags().StringVar(&spaceliftClient.APIKeyID, "spacelift-key-id", "", "The spacelift api key ID")
-	rootCmd.Flags().StringVar(&spaceliftClient.APIKeySecret, "spacelift-key-secret", "", "the spacelift api key secret")
+	rootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "", "config file, directory of config files, or glob (default is .vault-token-injector.yaml in the current directory)")
+	rootCmd.PersistentFlags().StringVar(&circleToken, "circle-token", "", "A circleci token.")
+	rootCmd.PersistentFlags().StringVar(&tfCloudToken, "tfcloud-token", "", "A token for TFCloud access.")
+	rootCmd.PersistentFlags().StringVar(&vaultTokenFile, "vault-token-file", "", "A file that contains a vault token. Optional - can set VAULT_TOKEN directly if preferred.")
+	rootCmd.PersistentFlags().StringVar(&spaceliftClient.URL, "spacelift-url", "", "The URL of the spacelift instance.")
+	rootCmd.PersistentFlags().StringVar(&spaceliftClient.APIKeyID, "spacelift-key-id", "", "The spacelift api key ID")
+	rootCmd.PersistentFlags().StringVar(&spaceliftClient.APIKeySecret, "spacelift-key-secret", "", "the spacelift api key secret")
+	rootCmd.PersistentFlags().StringVar(&githubClient.Token, "github-token", "", "A GitHub token that can manage Actions secrets.")
+	rootCmd.PersistentFlags().StringVar(&githubClient.URL, "github-url", github.DefaultURL, "The URL of the GitHub API.")
+	rootCmd.PersistentFlags().StringVar(&gitlabClient.Token, "gitlab-token", "", "A GitLab token with the api scope.")
+	rootCmd.PersistentFlags().StringVar(&gitlabClient.URL, "gitlab-url", gitlab.DefaultURL, "The URL of the GitLab instance.")
 	rootCmd.Flags().BoolVar(&enableMetrics, "enable-metrics", true, "Enable a prometheus endpoint on port 4329.")
 	rootCmd.Flags().BoolVar(&runOnce, "run-once", false, "If true, will run the token injection one time. Does not enable health endpoint or metrics.")
+	rootCmd.Flags().BoolVar(&watchConfig, "watch-config", true, "If true, will reload the config file when it changes without restarting.")
+	rootCmd.Flags().BoolVar(&dryRun, "dry-run", false, "If true, will print what would be injected into each target without creating tokens or writing anything. Same as the plan command.")
 
 	envMap := map[string]string{
 		"CIRCLE_CI_TOKEN":      "circle-token",
@@ -90,10 +124,14 @@ func init() {
 		"SPACELIFT_KEY_ID":     "spacelift-key-id",
 		"SPACELIFT_KEY_SECRET": "spacelift-key-secret",
 		"SPACELIFT_URL":        "spacelift-url",
+		"GITHUB_TOKEN":         "github-token",
+		"GITHUB_API_URL":       "github-url",
+		"GITLAB_TOKEN":         "gitlab-token",
+		"GITLAB_URL":           "gitlab-url",
 	}
 
 	for env, flagName := range envMap {
-		flag := rootCmd.Flags().Lookup(flagName)
+		flag := rootCmd.PersistentFlags().Lookup(flagName)
 		if flag == nil {
 			klog.Errorf("Could not find flag %s", flagName)
 			continue
@@ -112,20 +150,19 @@ func init() {
 	pflag.CommandLine.AddGoFlag(flag.CommandLine.Lookup("v"))
 }
 
-// initConfig reads in config file and ENV variables if set.
+// initConfig finds the config file if one was not given
 func initConfig() {
 	if cfgFile != "" {
-		// Use config file from the flag.
-		viper.SetConfigFile(cfgFile)
-	} else {
-		// Search config in home directory with name ".vault-token-injector" (without extension).
-		viper.SetConfigName(".vault-token-injector")
-		viper.SetConfigType("yaml")
-		viper.AddConfigPath(".")
+		klog.Infof("Using config: %s", cfgFile)
+		return
 	}
-	// If a config file is found, read it in.
+	// Search config in the current directory with name ".vault-token-injector" (without extension).
+	viper.SetConfigName(".vault-token-injector")
+	viper.SetConfigType("yaml")
+	viper.AddConfigPath(".")
 	if err := viper.ReadInConfig(); err == nil {
-		klog.Infof("Using config file: %s", viper.ConfigFileUsed())
+		cfgFile = viper.ConfigFileUsed()
+		klog.Infof("Using config file: %s", cfgFile)
 	} else {
 		klog.Fatal("Failed reading a config file.")
 	}
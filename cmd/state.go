@@ -0,0 +1,79 @@
+/*
+Copyright © 2021 FairwindsOps
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/fairwindsops/vault-token-injector/pkg/app"
+)
+
+func init() {
+	rootCmd.AddCommand(stateCmd)
+}
+
+var stateCmd = &cobra.Command{
+	Use:   "state",
+	Short: "Prints when each target was last injected.",
+	Long:  `Prints the injection history of each target from the state backend in the config file.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, _, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		records, err := app.LoadState(cmd.Context(), config)
+		if err != nil {
+			return err
+		}
+		ids := make([]string, 0, len(records))
+		for id := range records {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TARGET\tLAST SUCCESS\tEXPIRES\tACCESSOR\tLAST ERROR")
+		for _, id := range ids {
+			record := records[id]
+			lastError := "-"
+			if record.LastError != "" {
+				lastError = fmt.Sprintf("%s (%s)", record.LastError, formatTime(record.LastErrorTime))
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", id, formatTime(record.LastSuccess), formatTime(record.ExpiresAt), orDash(record.Accessor), lastError)
+		}
+		return w.Flush()
+	},
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,48 @@
+/*
+Copyright © 2021 FairwindsOps
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+}
+
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Checks the config files for problems.",
+	Long: `Checks the config files for unknown fields, invalid values, duplicate targets, and missing
+provider credentials, and prints every problem found with its line in the config file. Nothing
+is contacted, so this can be run without vault or provider access. The same checks are run on
+startup. Exits non-zero if there are any problems.`,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		enableMetrics = false
+		_, files, err := newApp()
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			fmt.Printf("%s is valid\n", file)
+		}
+		return nil
+	},
+}
@@ -1,21 +1,26 @@
 package app
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
-	"os/signal"
 	"strings"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"k8s.io/klog/v2"
 
-	"github.com/fairwindsops/vault-token-injector/pkg/circleci"
+	"github.com/fairwindsops/vault-token-injector/pkg/crd"
+	"github.com/fairwindsops/vault-token-injector/pkg/github"
+	"github.com/fairwindsops/vault-token-injector/pkg/gitlab"
+	"github.com/fairwindsops/vault-token-injector/pkg/leader"
+	"github.com/fairwindsops/vault-token-injector/pkg/retry"
 	"github.com/fairwindsops/vault-token-injector/pkg/spacelift"
-	"github.com/fairwindsops/vault-token-injector/pkg/tfcloud"
+	"github.com/fairwindsops/vault-token-injector/pkg/state"
+	"github.com/fairwindsops/vault-token-injector/pkg/target"
 	"github.com/fairwindsops/vault-token-injector/pkg/vault"
 )
 
@@ -29,13 +34,44 @@ type App struct {
 	EnableMetrics   bool
 	Metrics         *Metrics
 	SpaceliftClient *spacelift.Client
+	GitHubClient    *github.Client
+	GitLabClient    *gitlab.Client
+
+	// injected holds the last token injected into each target, by target ID
+	injected map[string]injectedToken
+	// revocations are the replaced tokens waiting out the grace period
+	revocations  []pendingRevocation
+	accessorLock sync.Mutex
+	// state keeps the injection history of each target, if configured
+	state state.Store
+	// injections lists VaultTokenInjection resources when the controller is enabled
+	injections *crd.Client
+	// reloads passes configs from Reload to the main loop
+	reloads    chan *Config
+	reloadOnce sync.Once
 }
 
 // Config represents the configuration file
 type Config struct {
-	CircleCI  []CircleCIConfig  `mapstructure:"circleci"`
-	TFCloud   []TFCloudConfig   `mapstructure:"tfcloud"`
-	Spacelift []SpaceliftConfig `mapstructure:"spacelift"`
+	// Include is a list of files, directories or globs of more config to merge in, relative to this file
+	Include  []string         `mapstructure:"include"`
+	CircleCI []CircleCIConfig `mapstructure:"circleci"`
+	TFCloud  []TFCloudConfig  `mapstructure:"tfcloud"`
+	// TFCloudDiscovery selects TFCloud workspaces to inject into on every run
+	TFCloudDiscovery []TFCloudDiscoveryConfig `mapstructure:"tfcloud_discovery"`
+	Spacelift        []SpaceliftConfig        `mapstructure:"spacelift"`
+	// SpaceliftDiscovery selects Spacelift stacks to inject into on every run
+	SpaceliftDiscovery []SpaceliftDiscoveryConfig `mapstructure:"spacelift_discovery"`
+	GitHub             []GitHubConfig             `mapstructure:"github"`
+	GitLab             []GitLabConfig             `mapstructure:"gitlab"`
+	// The CircleCI URL to use for all projects and contexts. Defaults to https://circleci.com
+	CircleCIURL string `mapstructure:"circleci_url"`
+	// The VCS type to use for all CircleCI projects and contexts, e.g. gh, bb or circleci. Defaults to gh
+	CircleCIVCSType string `mapstructure:"circleci_vcs_type"`
+	// The TFCloud or Terraform Enterprise address to use for all workspaces. Defaults to https://app.terraform.io
+	TFCloudAddress string `mapstructure:"tfcloud_address"`
+	// A file of PEM encoded CA certificates to trust when talking to Terraform Enterprise
+	TFCloudCABundle string `mapstructure:"tfcloud_ca_bundle"`
 	// The address of the vault server to use when creating tokens
 	VaultAddress string `mapstructure:"vault_address"`
 	// The variable name to use when setting a vault token. Defaults to VAULT_ADDR
@@ -46,92 +82,365 @@ type Config struct {
 	TokenTTL time.Duration `mapstructure:"token_ttl"`
 	// The interval at which the token will be refreshed. Defaults to 1 hour
 	TokenRefreshInterval time.Duration `mapstructure:"token_refresh_interval"`
+	// If true, the token previously injected into a target is revoked once its replacement has been written
+	RevokePreviousTokens bool `mapstructure:"revoke_previous_tokens"`
+	// How long to wait before revoking a replaced token, so that in-flight jobs can finish. Defaults to 0
+	RevokeGracePeriod time.Duration `mapstructure:"revoke_grace_period"`
+	// The fraction of its TTL after which a token injected before a restart is replaced. Only used when a state backend
+	// is configured. Defaults to replacing tokens that are older than the refresh interval
+	RotationThreshold float64 `mapstructure:"rotation_threshold"`
+	// The window over which the first refresh of each target is spread, so that they are not all refreshed at once. Defaults to the token refresh interval
+	RefreshStaggerWindow time.Duration `mapstructure:"refresh_stagger_window"`
+	// The largest fraction of the refresh interval that each refresh is randomly brought forward by. Defaults to 0
+	RefreshJitter float64 `mapstructure:"refresh_jitter"`
+	// How long to wait for in-flight token injections to finish when shutting down before cancelling them. Defaults to 30 seconds
+	ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout"`
+	// Retry configures how failed calls to vault and the provider APIs are retried
+	Retry RetryConfig `mapstructure:"retry"`
+	// LeaderElection makes sure only one replica injects tokens at a time. Defaults to disabled
+	LeaderElection LeaderElectionConfig `mapstructure:"leader_election"`
+	// State configures where the injection history of each target is kept. Defaults to not keeping it
+	State StateConfig `mapstructure:"state"`
+	// Controller injects into targets declared as VaultTokenInjection resources. Defaults to disabled
+	Controller ControllerConfig `mapstructure:"controller"`
+	// VaultAuth configures how the injector authenticates to vault. Defaults to a static token
+	VaultAuth VaultAuthConfig `mapstructure:"vault_auth"`
+}
+
+// RetryConfig configures how failed calls are retried. Unset fields keep their defaults
+type RetryConfig struct {
+	// MaxAttempts is the total number of attempts, including the first one. Defaults to 4
+	MaxAttempts int `mapstructure:"max_attempts"`
+	// InitialBackoff is the wait before the first retry. It doubles after each attempt. Defaults to 1 second
+	InitialBackoff time.Duration `mapstructure:"initial_backoff"`
+	// MaxBackoff caps the wait between attempts, including waits requested by rate limit headers. Defaults to 1 minute
+	MaxBackoff time.Duration `mapstructure:"max_backoff"`
+	// Jitter is the largest fraction of each wait that is randomly added to it. Defaults to 0.2, and 0 disables it
+	Jitter *float64 `mapstructure:"jitter"`
+}
+
+// LeaderElectionConfig configures leader election between replicas
+type LeaderElectionConfig struct {
+	// Method is the leader election method. One of kubernetes or file. Leader election is disabled when empty
+	Method string `mapstructure:"method"`
+	// Name is the name of the Lease used by the kubernetes method. Defaults to vault-token-injector
+	Name string `mapstructure:"name"`
+	// Namespace is the namespace of the Lease used by the kubernetes method. Defaults to the pod's namespace
+	Namespace string `mapstructure:"namespace"`
+	// LockFile is the file locked by the file method
+	LockFile string `mapstructure:"lock_file"`
+	// LeaseDuration is how long followers wait before taking over from a leader that stopped renewing. Defaults to 15 seconds
+	LeaseDuration time.Duration `mapstructure:"lease_duration"`
+	// RenewDeadline is how long the leader keeps trying to renew before giving up leadership. Defaults to 10 seconds
+	RenewDeadline time.Duration `mapstructure:"renew_deadline"`
+	// RetryPeriod is how often the leader renews and followers try to take over. Defaults to 2 seconds
+	RetryPeriod time.Duration `mapstructure:"retry_period"`
+}
+
+// StateConfig configures the store that keeps the injection history of each target
+type StateConfig struct {
+	// Backend is the store to use. One of file, configmap, or secret. History is not kept when empty
+	Backend string `mapstructure:"backend"`
+	// Path is the file used by the file backend
+	Path string `mapstructure:"path"`
+	// Name is the name of the ConfigMap or Secret. Defaults to vault-token-injector-state
+	Name string `mapstructure:"name"`
+	// Namespace is the namespace of the ConfigMap or Secret. Defaults to the pod's namespace
+	Namespace string `mapstructure:"namespace"`
+}
+
+// ControllerConfig configures which VaultTokenInjection resources are injected into
+type ControllerConfig struct {
+	// Enabled turns on injecting into targets declared as VaultTokenInjection resources
+	Enabled bool `mapstructure:"enabled"`
+	// Namespaces are the namespaces resources are read from, and what the resources in each may ask for
+	Namespaces []ControllerNamespaceConfig `mapstructure:"namespaces"`
+	// LabelSelector limits the resources to those with matching labels
+	LabelSelector string `mapstructure:"label_selector"`
+	// ResyncInterval is how often resources are listed to pick up changes. Targets from the config file and
+	// discovery are listed at the same time. Defaults to 1 minute
+	ResyncInterval time.Duration `mapstructure:"resync_interval"`
+}
+
+// ControllerNamespaceConfig is a namespace to read VaultTokenInjection resources from
+type ControllerNamespaceConfig struct {
+	// Namespace is the name of the namespace
+	Namespace string `mapstructure:"namespace"`
+	// VaultRoles are the vault roles resources in the namespace may use
+	VaultRoles []string `mapstructure:"vault_roles"`
+	// VaultPolicies are the vault policies resources in the namespace may give their tokens
+	VaultPolicies []string `mapstructure:"vault_policies"`
+	// AllowOrphanTokens lets resources in the namespace ask for orphan tokens
+	AllowOrphanTokens bool `mapstructure:"allow_orphan_tokens"`
+}
+
+// VaultAuthConfig configures the identity the injector itself uses to talk to vault
+type VaultAuthConfig struct {
+	// Method is the auth method to use. One of token, kubernetes, or approle. Defaults to token
+	Method string `mapstructure:"method"`
+	// Mount is the path the auth method is mounted at. Defaults to the name of the method
+	Mount string `mapstructure:"mount"`
+	// Role is the vault role to log in as
+	Role string `mapstructure:"role"`
+	// JWTFile is the service account token used for kubernetes auth. Defaults to the in-cluster token
+	JWTFile string `mapstructure:"jwt_file"`
+	// RoleIDFile is a file containing the approle role_id. Defaults to the VAULT_ROLE_ID env var
+	RoleIDFile string `mapstructure:"role_id_file"`
+	// SecretIDFile is a file containing the approle secret_id. Defaults to the VAULT_SECRET_ID env var
+	SecretIDFile string `mapstructure:"secret_id_file"`
 }
 
-// CircleCIConfig represents a specific instance of a CircleCI project we want to
+// TokenOverrides are per-target overrides of the global token settings. Unset
+// fields fall back to the global setting of the same name.
+type TokenOverrides struct {
+	// The TTL of the tokens created for this target
+	TokenTTL time.Duration `mapstructure:"token_ttl"`
+	// The interval at which the token for this target will be refreshed
+	TokenRefreshInterval time.Duration `mapstructure:"token_refresh_interval"`
+	// The variable name to use when setting the vault token in this target
+	TokenVariable string `mapstructure:"token_variable"`
+	// If set, overrides whether the tokens for this target are created as orphans
+	OrphanTokens *bool `mapstructure:"orphan_tokens"`
+}
+
+func (o TokenOverrides) tokenOptions(role *string, policies []string) target.TokenOptions {
+	return target.TokenOptions{
+		VaultRole:       role,
+		VaultPolicies:   policies,
+		TTL:             o.TokenTTL,
+		RefreshInterval: o.TokenRefreshInterval,
+		TokenVariable:   o.TokenVariable,
+		Orphan:          o.OrphanTokens,
+	}
+}
+
+// CircleCIConfig represents a specific instance of a CircleCI project or context we want to
 // update an environment variable for
 type CircleCIConfig struct {
-	Name          string   `mapstructure:"name"`
+	// Name is the org/repo name of a project. Mutually exclusive with Context
+	Name string `mapstructure:"name"`
+	// Context is the name of a context to update instead of a project
+	Context string `mapstructure:"context"`
+	// Organization is the organization that owns the context. Required when Context is set
+	Organization string `mapstructure:"organization"`
+	// VCSType overrides the global circleci_vcs_type for this project or context
+	VCSType string `mapstructure:"vcs_type"`
+	// URL overrides the global circleci_url for this project or context
+	URL           string   `mapstructure:"url"`
 	VaultRole     *string  `mapstructure:"vault_role"`
 	VaultPolicies []string `mapstructure:"vault_policies"`
+	// TokenOverrides overrides the global token settings
+	TokenOverrides `mapstructure:",squash"`
 }
 
-// TFCloudConfig represents a specific instance of a TFCloud workspace we want to
+// TFCloudConfig represents a specific instance of a TFCloud workspace or variable set we want to
 // update an environment variable for
 type TFCloudConfig struct {
-	// Workspace is the ID of the workspace in tfcloud. Should begin with ws- and is required
+	// Workspace is the ID of the workspace in tfcloud. Should begin with ws- and is required unless VariableSet is set
 	Workspace string `mapstructure:"workspace"`
+	// VariableSet is the name of a variable set to update instead of a workspace. It is created if it does not exist
+	VariableSet string `mapstructure:"variable_set"`
+	// Organization is the organization that owns the variable set. Required when VariableSet is set
+	Organization string `mapstructure:"organization"`
+	// WorkspaceTags applies the variable set to every workspace that has all of these tags
+	WorkspaceTags []string `mapstructure:"workspace_tags"`
+	// ProjectTags applies the variable set to every project with these tag bindings, given as key or key=value
+	ProjectTags []string `mapstructure:"project_tags"`
+	// Address overrides the global tfcloud_address for this workspace or variable set
+	Address string `mapstructure:"address"`
+	// CABundle overrides the global tfcloud_ca_bundle for this workspace or variable set
+	CABundle string `mapstructure:"ca_bundle"`
 	// Name is an optional field that can be used to identify a workspace
 	Name string `mapstructure:"name"`
 	// VaultRole is the vault role to use for the token in this workspace
 	VaultRole *string `mapstructure:"vault_role"`
 	// VaultPolicies is a list of policies that will be given to the token in this workspace
 	VaultPolicies []string `mapstructure:"vault_policies"`
+	// TokenOverrides overrides the global token settings
+	TokenOverrides `mapstructure:",squash"`
 }
 
+// TFCloudDiscoveryConfig selects TFCloud workspaces by tag, project, or name. Matching
+// workspaces are looked up on every run, so new workspaces get a token without a config change
+type TFCloudDiscoveryConfig struct {
+	// Organization is the TFCloud organization to search. Required
+	Organization string `mapstructure:"organization"`
+	// Tags selects workspaces that have all of these tags
+	Tags []string `mapstructure:"tags"`
+	// Project selects workspaces in the project with this name
+	Project string `mapstructure:"project"`
+	// NameRegex selects workspaces with a name matching this regular expression
+	NameRegex string `mapstructure:"name_regex"`
+	// Address overrides the global tfcloud_address for these workspaces
+	Address string `mapstructure:"address"`
+	// CABundle overrides the global tfcloud_ca_bundle for these workspaces
+	CABundle string `mapstructure:"ca_bundle"`
+	// VaultRole is the vault role to use for the token in each workspace
+	VaultRole *string `mapstructure:"vault_role"`
+	// VaultPolicies is a list of policies that will be given to the token in each workspace
+	VaultPolicies []string `mapstructure:"vault_policies"`
+	// TokenOverrides overrides the global token settings
+	TokenOverrides `mapstructure:",squash"`
+}
+
+// SpaceliftConfig represents a Spacelift stack or context we want to inject vars into
 type SpaceliftConfig struct {
 	// Stack is the name of a Spacelift stack that you want to inject vars into
 	Stack string `mapstructure:"stack"`
+	// Context is the ID of a Spacelift context to inject vars into instead of a stack.
+	// Every stack the context is attached to inherits the vars
+	Context string `mapstructure:"context"`
 	// VaultRole is the vault role to use for the token in this stack
 	VaultRole *string `mapstructure:"vault_role"`
 	// VaultPolicies is a list of policies that will be given to the token in this stack
 	VaultPolicies []string `mapstructure:"vault_policies"`
+	// TokenOverrides overrides the global token settings
+	TokenOverrides `mapstructure:",squash"`
+}
+
+// SpaceliftDiscoveryConfig selects Spacelift stacks by label and space. Matching stacks
+// are looked up on every run, so new stacks get a token without a config change
+type SpaceliftDiscoveryConfig struct {
+	// Labels selects stacks that have all of these labels
+	Labels []string `mapstructure:"labels"`
+	// Spaces selects stacks in any of these spaces, given by ID or name
+	Spaces []string `mapstructure:"spaces"`
+	// VaultRole is the vault role to use for the token in each stack
+	VaultRole *string `mapstructure:"vault_role"`
+	// VaultPolicies is a list of policies that will be given to the token in each stack
+	VaultPolicies []string `mapstructure:"vault_policies"`
+	// TokenOverrides overrides the global token settings
+	TokenOverrides `mapstructure:",squash"`
+}
+
+// GitHubConfig represents a GitHub repository, repository environment, or organization
+// we want to set GitHub Actions secrets in
+type GitHubConfig struct {
+	// Repository is the owner/name of a repository to set secrets in
+	Repository string `mapstructure:"repository"`
+	// Environment is an optional environment within the repository to set secrets in
+	Environment string `mapstructure:"environment"`
+	// Organization is the name of an organization to set secrets in. Mutually exclusive with Repository
+	Organization string `mapstructure:"organization"`
+	// Visibility is the visibility of organization secrets. One of all, private or selected. Defaults to private
+	Visibility string `mapstructure:"visibility"`
+	// SelectedRepositoryIDs are the IDs of the repositories that can use organization secrets with selected visibility
+	SelectedRepositoryIDs []int64 `mapstructure:"selected_repository_ids"`
+	// VaultRole is the vault role to use for the token
+	VaultRole *string `mapstructure:"vault_role"`
+	// VaultPolicies is a list of policies that will be given to the token
+	VaultPolicies []string `mapstructure:"vault_policies"`
+	// TokenOverrides overrides the global token settings
+	TokenOverrides `mapstructure:",squash"`
+}
+
+// GitLabConfig represents a GitLab project or group we want to set a CI/CD variable in
+type GitLabConfig struct {
+	// Project is the ID or full path of a project to set variables in
+	Project string `mapstructure:"project"`
+	// Group is the ID or full path of a group to set variables in. Mutually exclusive with Project
+	Group string `mapstructure:"group"`
+	// Protected limits the variables to protected branches and tags
+	Protected bool `mapstructure:"protected"`
+	// VaultRole is the vault role to use for the token
+	VaultRole *string `mapstructure:"vault_role"`
+	// VaultPolicies is a list of policies that will be given to the token
+	VaultPolicies []string `mapstructure:"vault_policies"`
+	// TokenOverrides overrides the global token settings
+	TokenOverrides `mapstructure:",squash"`
 }
 
 // NewApp creates a new App from the given configuration options
-func NewApp(circleToken, vaultTokenFile, tfCloudToken string, config *Config, enableMetrics bool, spaceliftClient *spacelift.Client) *App {
+func NewApp(circleToken, vaultTokenFile, tfCloudToken string, config *Config, enableMetrics bool, spaceliftClient *spacelift.Client, githubClient *github.Client, gitlabClient *gitlab.Client) *App {
 	app := &App{
 		Config:          config,
 		CircleToken:     circleToken,
 		TFCloudToken:    tfCloudToken,
 		VaultTokenFile:  vaultTokenFile,
 		SpaceliftClient: spaceliftClient,
+		GitHubClient:    githubClient,
+		GitLabClient:    gitlabClient,
 		EnableMetrics:   enableMetrics,
 	}
 
-	if len(app.Config.CircleCI) > 0 && circleToken == "" {
-		klog.Error("CircleCI is configured but no token was provided.")
-	}
-
-	if len(app.Config.TFCloud) > 0 && tfCloudToken == "" {
-		klog.Error("TFCloud is configured but no token was provided.")
-	}
-	if app.Config.TokenVariable == "" {
-		app.Config.TokenVariable = "VAULT_TOKEN"
-		klog.Warningf("token variable not set, defaulting to %s", app.Config.TokenVariable)
-	}
-
-	if app.Config.TokenTTL == 0 {
-		app.Config.TokenTTL = time.Minute * 60
-		klog.V(4).Infof("token TTL not set, defaulting to %s", app.Config.TokenTTL.String())
-	}
-
-	if app.Config.TokenRefreshInterval == 0 {
-		app.Config.TokenRefreshInterval = time.Minute * 30
-		klog.V(3).Infof("token refresh interval not set, defaulting to %s", app.Config.TokenRefreshInterval.String())
-	}
+	setDefaults(app.Config)
+	setRetryPolicy(app.Config.Retry)
 
 	klog.V(3).Infof("Token Variable: %s", app.Config.TokenVariable)
 	klog.V(3).Infof("Token TTL: %s", app.Config.TokenTTL.String())
 	klog.V(3).Infof("Token Refresh Interval: %s", app.Config.TokenRefreshInterval.String())
+	klog.V(3).Infof("Refresh Stagger Window: %s", app.Config.RefreshStaggerWindow.String())
+	klog.V(3).Infof("Refresh Jitter: %v", app.Config.RefreshJitter)
+	klog.V(3).Infof("Retry Policy: %+v", retry.DefaultPolicy())
 	klog.V(3).Infof("Vault Address: %s", app.Config.VaultAddress)
 	klog.V(3).Infof("Orphan Tokens: %t", app.Config.OrphanTokens)
+	klog.V(3).Infof("Vault Auth Method: %s", app.Config.VaultAuth.Method)
+	klog.V(3).Infof("Revoke Previous Tokens: %t", app.Config.RevokePreviousTokens)
+	klog.V(3).Infof("Revoke Grace Period: %s", app.Config.RevokeGracePeriod.String())
 	klog.V(3).Infof("Circle Configs: %v", app.Config.CircleCI)
 	klog.V(3).Infof("TFCloud Configs: %v", app.Config.TFCloud)
+	klog.V(3).Infof("TFCloud Discovery Configs: %v", app.Config.TFCloudDiscovery)
+	klog.V(3).Infof("Spacelift Configs: %v", app.Config.Spacelift)
+	klog.V(3).Infof("Spacelift Discovery Configs: %v", app.Config.SpaceliftDiscovery)
+	klog.V(3).Infof("GitHub Configs: %v", app.Config.GitHub)
+	klog.V(3).Infof("GitLab Configs: %v", app.Config.GitLab)
 
 	return app
 }
 
-// Run starts the application
-func (a *App) Run() error {
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-sigs
-		klog.Info("exiting - received termination signal")
-		os.Exit(0)
-	}()
+// setDefaults fills in the defaults of any settings that are not set in the config
+func setDefaults(config *Config) {
+	if config.TokenVariable == "" {
+		config.TokenVariable = "VAULT_TOKEN"
+		klog.Warningf("token variable not set, defaulting to %s", config.TokenVariable)
+	}
+
+	if config.TokenTTL == 0 {
+		config.TokenTTL = time.Minute * 60
+		klog.V(4).Infof("token TTL not set, defaulting to %s", config.TokenTTL.String())
+	}
+
+	if config.TokenRefreshInterval == 0 {
+		config.TokenRefreshInterval = time.Minute * 30
+		klog.V(3).Infof("token refresh interval not set, defaulting to %s", config.TokenRefreshInterval.String())
+	}
+
+	if config.RefreshStaggerWindow == 0 && config.TokenRefreshInterval > 0 {
+		config.RefreshStaggerWindow = config.TokenRefreshInterval
+		klog.V(3).Infof("refresh stagger window not set, defaulting to %s", config.RefreshStaggerWindow.String())
+	}
+
+	if config.ShutdownTimeout == 0 {
+		config.ShutdownTimeout = time.Second * 30
+		klog.V(3).Infof("shutdown timeout not set, defaulting to %s", config.ShutdownTimeout.String())
+	}
+
+	if config.Controller.Enabled && config.Controller.ResyncInterval == 0 {
+		config.Controller.ResyncInterval = time.Minute
+		klog.V(3).Infof("controller resync interval not set, defaulting to %s", config.Controller.ResyncInterval.String())
+	}
+}
+
+// setRetryPolicy sets the retry policy used for calls to vault and the providers.
+// Fields that are not set in the config go back to their defaults.
+func setRetryPolicy(config RetryConfig) {
+	jitter := retry.BuiltinPolicy().Jitter
+	if config.Jitter != nil {
+		jitter = *config.Jitter
+	}
+	retry.SetDefaultPolicy(retry.Policy{
+		MaxAttempts:    config.MaxAttempts,
+		InitialBackoff: config.InitialBackoff,
+		MaxBackoff:     config.MaxBackoff,
+		Jitter:         jitter,
+	})
+}
 
+// Run starts the application. It returns once the context is done and any
+// in-flight token injections have finished or the shutdown timeout has passed.
+// When leader election is enabled, only the leader runs the main loop and the
+// other replicas wait to take over.
+func (a *App) Run(ctx context.Context) error {
 	if a.EnableMetrics {
 		a.registerMetrics()
 		http.Handle("/metrics", promhttp.Handler())
@@ -139,21 +448,200 @@ func (a *App) Run() error {
 		go http.ListenAndServe(":4329", nil)
 	}
 
+	if err := a.openState(); err != nil {
+		return err
+	}
+
+	elector, err := a.elector()
+	if err != nil {
+		return err
+	}
+	if elector == nil {
+		a.runLoop(ctx)
+		return nil
+	}
+	return elector.Run(ctx, func(ctx context.Context) {
+		a.setLeader(true)
+		defer a.setLeader(false)
+		a.runLoop(ctx)
+	})
+}
+
+// runLoop refreshes each target when it is due until the context is done
+func (a *App) runLoop(ctx context.Context) {
+	workCtx, cancel := a.workContext(ctx)
+	defer cancel()
+
+	// Load the history here rather than at startup, as a replica that has just
+	// become the leader needs what the previous leader recorded
+	records := a.loadState(ctx)
+
 	klog.Info("starting main application loop")
+	sched := newScheduler(a.Config.RefreshStaggerWindow, a.Config.RefreshJitter)
+	targets := map[string]target.Target{}
+	// settings is the token settings hash of each target as of the last listing
+	var settings map[string]string
+	var nextList time.Time
+	var reloaded *Config
+	// vaultFailures is the number of times in a row a valid vault token could not be obtained
+	vaultFailures := 0
 	for {
-		var wg sync.WaitGroup
-		if err := a.injectVars(&wg); err != nil {
-			time.Sleep(a.Config.TokenRefreshInterval)
-			continue
+		if ctx.Err() != nil {
+			klog.Info("stopping main application loop")
+			return
+		}
+		// A reloaded config is only swapped in here, when no injections are in flight
+		if reloaded == nil {
+			reloaded = a.pendingReload()
+		}
+		if reloaded != nil {
+			a.applyConfig(reloaded, sched)
+			reloaded = nil
+			nextList = time.Time{}
 		}
-		wg.Wait()
+		now := time.Now()
+		// Listing targets can mean calling provider APIs for discovery, so only
+		// do it once per refresh interval rather than on every wake up
+		if !now.Before(nextList) {
+			previous := targets
+			targets = map[string]target.Target{}
+			for _, t := range a.listTargets(ctx) {
+				targets[target.ID(t)] = t
+			}
+			if len(previous) > 0 {
+				logTargetChanges(previous, targets)
+			}
+			intervals := make(map[string]time.Duration, len(targets))
+			for id, t := range targets {
+				intervals[id] = a.tokenSettings(t.TokenOptions()).RefreshInterval
+				// Tokens injected before a restart that are still fresh are
+				// replaced when they go stale rather than straight away
+				if freshUntil := a.freshUntil(records[id], t); now.Before(freshUntil) {
+					klog.Infof("token in %s target %s is still fresh, next refresh at %s", t.Provider(), t.Name(), freshUntil.String())
+					sched.schedule(id, freshUntil)
+				}
+			}
+			records = nil
+			settings = a.rescheduleChanged(sched, targets, settings, now)
+			sched.update(intervals, now)
+			nextList = now.Add(a.listInterval())
+		}
+
+		revocationsDue := a.revocationsDue(now)
+		if due := sched.due(now); (len(due) > 0 || revocationsDue) && ctx.Err() == nil {
+			if err := a.refreshVaultToken(ctx); err != nil {
+				vaultFailures++
+				wait := vaultBackoff(vaultFailures)
+				klog.Errorf("unable to get a valid token, retrying in %s: %s", wait.String(), err)
+				a.incrementVaultError()
+				reloaded = a.waitUntil(ctx, time.Now().Add(wait))
+				continue
+			}
+			vaultFailures = 0
+			var wg sync.WaitGroup
+			for _, id := range due {
+				t := targets[id]
+				sched.refreshed(id, now, a.tokenSettings(t.TokenOptions()).RefreshInterval)
+				wg.Add(1)
+				go a.updateTarget(workCtx, t, &wg)
+			}
+			wg.Wait()
+			a.revokeDue(workCtx, time.Now())
+		}
+
+		wakeAt := nextList
+		if next := sched.next(); !next.IsZero() && next.Before(wakeAt) {
+			wakeAt = next
+		}
+		if next := a.nextRevocation(); !next.IsZero() && next.Before(wakeAt) {
+			wakeAt = next
+		}
+		reloaded = a.waitUntil(ctx, wakeAt)
+	}
+}
+
+const (
+	// vaultRetryInitialBackoff is the wait before retrying after failing to get a valid vault token
+	vaultRetryInitialBackoff = time.Second * 10
+	// vaultRetryMaxBackoff caps the wait between attempts to get a valid vault token
+	vaultRetryMaxBackoff = time.Minute * 5
+)
 
-		time.Sleep(a.Config.TokenRefreshInterval)
+// vaultBackoff returns how long to wait after failing to get a valid vault token
+// the given number of times in a row. The targets that were due are still due,
+// so they are refreshed as soon as a token can be obtained.
+func vaultBackoff(failures int) time.Duration {
+	wait := vaultRetryInitialBackoff
+	for i := 1; i < failures && wait < vaultRetryMaxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, vaultRetryMaxBackoff)
+}
+
+const (
+	leaderElectionKubernetes = "kubernetes"
+	leaderElectionFile       = "file"
+)
+
+// elector returns the configured leader elector, or nil if leader election is disabled
+func (a *App) elector() (leader.Elector, error) {
+	config := a.Config.LeaderElection
+	switch config.Method {
+	case "":
+		return nil, nil
+	case leaderElectionKubernetes:
+		return &leader.LeaseElector{
+			Name:          config.Name,
+			Namespace:     config.Namespace,
+			LeaseDuration: config.LeaseDuration,
+			RenewDeadline: config.RenewDeadline,
+			RetryPeriod:   config.RetryPeriod,
+		}, nil
+	case leaderElectionFile:
+		return &leader.FileElector{
+			Path:        config.LockFile,
+			RetryPeriod: config.RetryPeriod,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown leader election method %s", config.Method)
+	}
+}
+
+// listInterval returns how often targets are listed. When the controller is enabled
+// they are listed more often, so that new and changed resources are picked up quickly
+func (a *App) listInterval() time.Duration {
+	interval := a.Config.TokenRefreshInterval
+	if a.Config.Controller.Enabled && a.Config.Controller.ResyncInterval < interval {
+		interval = a.Config.Controller.ResyncInterval
+	}
+	return interval
+}
+
+// workContext returns a context for token injections that is only cancelled once
+// the shutdown timeout has passed after ctx is done. This gives in-flight writes
+// a chance to finish, so that a target is not left with a new token but stale
+// variables alongside it. If ctx was cancelled because leadership was lost, the
+// work is cancelled straight away instead, as the new leader may already be
+// writing to the same targets.
+func (a *App) workContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	workCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, func() {
+		if errors.Is(context.Cause(ctx), leader.ErrLostLeadership) {
+			klog.Warning("lost leadership, cancelling in-flight token injections")
+			cancel()
+			return
+		}
+		klog.Infof("waiting up to %s for in-flight token injections to finish", a.Config.ShutdownTimeout.String())
+		time.AfterFunc(a.Config.ShutdownTimeout, cancel)
+	})
+	return workCtx, func() {
+		stop()
+		cancel()
 	}
 }
 
 // RunOnce just does a single run for use with a Kubernetes cronjob
-func (a *App) RunOnce() error {
+func (a *App) RunOnce(ctx context.Context) error {
 
 	klog.Info("running the token injection once")
 
@@ -163,11 +651,29 @@ func (a *App) RunOnce() error {
 		go http.ListenAndServe(":4329", nil)
 	}
 
+	if err := a.openState(); err != nil {
+		return err
+	}
+
+	workCtx, cancel := a.workContext(ctx)
+	defer cancel()
+
 	var wg sync.WaitGroup
-	if err := a.injectVars(&wg); err != nil {
+	if err := a.injectVars(workCtx, &wg); err != nil {
 		return err
 	}
 	wg.Wait()
+	// Tokens replaced in this run, or in an earlier run, are revoked once their
+	// grace period has passed. Any still waiting are left in the injection history
+	// for a later run.
+	a.revokeDue(workCtx, time.Now())
+	if next := a.nextRevocation(); !next.IsZero() {
+		if a.state == nil {
+			klog.Warningf("replaced tokens cannot be revoked after the grace period without a state backend")
+		} else {
+			klog.Infof("replaced tokens still in their grace period will be revoked on a later run")
+		}
+	}
 	errCount := getMetricValue(a.Metrics.totalErrorCount)
 	if errCount > 0 {
 		return fmt.Errorf("there were errors during during the run. see the logs for more details")
@@ -175,137 +681,177 @@ func (a *App) RunOnce() error {
 	return nil
 }
 
-func (a *App) injectVars(wg *sync.WaitGroup) error {
-	if err := a.refreshVaultToken(); err != nil {
+// injectVars refreshes every target at once, except targets whose token is still fresh
+func (a *App) injectVars(ctx context.Context, wg *sync.WaitGroup) error {
+	records := a.loadState(ctx)
+	if err := a.refreshVaultToken(ctx); err != nil {
 		klog.Errorf("unable to get a valid token, skipping loop: %s", err)
 		a.incrementVaultError()
 		return err
 	}
-	for _, workspace := range a.Config.TFCloud {
-		wg.Add(1)
-		go a.updateTFCloudInstance(workspace, wg)
-	}
-	for _, project := range a.Config.CircleCI {
-		wg.Add(1)
-		go a.updateCircleCIInstance(project, wg)
-	}
-	for _, stack := range a.Config.Spacelift {
+	now := time.Now()
+	for _, t := range a.listTargets(ctx) {
+		if freshUntil := a.freshUntil(records[target.ID(t)], t); now.Before(freshUntil) {
+			klog.Infof("skipping %s target %s, its token is still fresh until %s", t.Provider(), t.Name(), freshUntil.String())
+			continue
+		}
 		wg.Add(1)
-		go a.updateSpaceliftInstance(stack, wg)
+		go a.updateTarget(ctx, t, wg)
 	}
 	return nil
 }
 
-func (a *App) updateCircleCIInstance(project CircleCIConfig, wg *sync.WaitGroup) {
-	defer wg.Done()
-	projName := project.Name
-	projVariableName := a.Config.TokenVariable
-	token, err := a.VaultClient.CreateToken(project.VaultRole, project.VaultPolicies, a.Config.TokenTTL, a.Config.OrphanTokens)
-	if err != nil {
-		a.incrementVaultError()
-		klog.Errorf("error making token for CircleCI project %s: %s", projName, err.Error())
-		return
+// listTargets returns the targets from every provider
+func (a *App) listTargets(ctx context.Context) []target.Target {
+	var targets []target.Target
+	for _, provider := range a.providers(false) {
+		// Providers may return some targets along with an error, so inject into
+		// whatever was returned
+		providerTargets, err := provider.Targets(ctx)
+		if err != nil {
+			a.incrementTargetError(provider.Name())
+			klog.Errorf("error listing targets for provider %s: %s", provider.Name(), err.Error())
+		}
+		targets = append(targets, providerTargets...)
 	}
-	klog.V(10).Infof("got token %s for CircleCI project %s", token.Auth.ClientToken, projName)
-	klog.Infof("setting env var %s to vault token value in CircleCI project %s", projVariableName, projName)
-	if err := circleci.UpdateEnvVar(projName, projVariableName, token.Auth.ClientToken, a.CircleToken); err != nil {
-		a.incrementCircleCIError()
-		klog.Errorf("error updating CircleCI project %s with token value: %s", projName, err.Error())
-		return
+	return targets
+}
+
+// tokenSettings fills in any settings not overridden by the target with the global settings
+func (a *App) tokenSettings(opts target.TokenOptions) target.TokenOptions {
+	if opts.TTL <= 0 {
+		opts.TTL = a.Config.TokenTTL
 	}
-	if err := circleci.UpdateEnvVar(projName, "VAULT_ADDR", a.Config.VaultAddress, a.CircleToken); err != nil {
-		a.incrementCircleCIError()
-		klog.Errorf("error updating VAULT_ADDR in CircleCI project %s: %s", projName, err.Error())
-		return
+	if opts.RefreshInterval <= 0 {
+		opts.RefreshInterval = a.Config.TokenRefreshInterval
 	}
-	if a.EnableMetrics {
-		a.Metrics.circleTokensUpdated.Inc()
+	if opts.TokenVariable == "" {
+		opts.TokenVariable = a.Config.TokenVariable
+	}
+	if opts.Orphan == nil {
+		opts.Orphan = &a.Config.OrphanTokens
 	}
+	return opts
 }
 
-func (a *App) updateSpaceliftInstance(instance SpaceliftConfig, wg *sync.WaitGroup) {
+// updateTarget creates a new vault token for the target and writes it, along with
+// VAULT_ADDR, to the target
+func (a *App) updateTarget(ctx context.Context, t target.Target, wg *sync.WaitGroup) {
 	defer wg.Done()
-	if err := a.SpaceliftClient.RefreshJWT(); err != nil {
-		klog.Errorf("could not refresh Spacelift API auth via JWT: %s", err.Error())
-		a.incrementSpaceliftError()
+	provider := t.Provider()
+	name := t.Name()
+	id := target.ID(t)
+	if err := t.Validate(); err != nil {
+		a.incrementTargetError(provider)
+		klog.Errorf("invalid %s target %s: %s", provider, name, err.Error())
+		a.recordError(ctx, t, err)
 		return
 	}
-
-	token, err := a.VaultClient.CreateToken(instance.VaultRole, instance.VaultPolicies, a.Config.TokenTTL, a.Config.OrphanTokens)
+	opts := a.tokenSettings(t.TokenOptions())
+	token, err := a.VaultClient.CreateToken(ctx, opts.VaultRole, opts.VaultPolicies, opts.TTL, *opts.Orphan)
 	if err != nil {
 		a.incrementVaultError()
-		klog.Errorf("error getting vault token for spacelift stack %s: %s", instance.Stack, err.Error())
+		klog.Errorf("error making token for %s target %s: %s", provider, name, err.Error())
+		a.recordError(ctx, t, err)
 		return
 	}
-	klog.V(10).Infof("got token %s for spacelift stack %s", token.Auth.ClientToken, instance.Stack)
+	klog.V(10).Infof("got token %s for %s target %s", token.Auth.ClientToken, provider, name)
+	klog.Infof("setting env var %s to vault token value in %s target %s", opts.TokenVariable, provider, name)
+	if err := t.SetVariables(ctx, a.targetVariables(opts, token.Auth.ClientToken)); err != nil {
+		a.incrementTargetError(provider)
+		klog.Errorf("error updating %s target %s: %s", provider, name, err.Error())
+		a.recordError(ctx, t, err)
+		var notWritten *target.NotWrittenError
+		if errors.As(err, &notWritten) {
+			a.revokeUnusedToken(ctx, id, token)
+		} else {
+			a.keepUnconfirmedToken(ctx, id, token)
+		}
+		return
+	}
+	klog.Infof("successfully updated vars in %s target %s", provider, name)
+	a.incrementTokensUpdated(provider)
+	now := time.Now()
+	replaced := a.replaceToken(id, token, now)
+	a.recordSuccess(ctx, t, token, replaced)
+	if replaced != nil {
+		a.revokeReplaced(ctx, pendingRevocation{id: id, Revocation: *replaced}, now)
+	}
+}
 
-	envVars := []spacelift.EnvVar{
+// targetVariables returns the variables written to a target: the token, followed by VAULT_ADDR
+func (a *App) targetVariables(opts target.TokenOptions, token string) []target.Variable {
+	return []target.Variable{
 		{
-			Key:       "VAULT_ADDR",
-			Value:     a.Config.VaultAddress,
-			WriteOnly: false,
+			Key:       opts.TokenVariable,
+			Value:     token,
+			Sensitive: true,
 		},
 		{
-			Key:       a.Config.TokenVariable,
-			Value:     token.Auth.ClientToken,
-			WriteOnly: true,
+			Key:       "VAULT_ADDR",
+			Value:     a.Config.VaultAddress,
+			Sensitive: false,
 		},
 	}
-	if err := a.SpaceliftClient.SetEnvVars(instance.Stack, envVars); err != nil {
-		a.incrementSpaceliftError()
-		klog.Errorf("error setting variables in Spacelift stack %s: %s", instance.Stack, err.Error())
-		return
-	}
-	klog.Infof("successfully updated spacelift vars in stack: %s", instance.Stack)
 }
 
-func (a *App) updateTFCloudInstance(instance TFCloudConfig, wg *sync.WaitGroup) {
-	defer wg.Done()
-	var workspaceLogIdentifier string
-	if instance.Name != "" {
-		workspaceLogIdentifier = instance.Name
-	} else {
-		workspaceLogIdentifier = instance.Workspace
-	}
-	token, err := a.VaultClient.CreateToken(instance.VaultRole, instance.VaultPolicies, a.Config.TokenTTL, a.Config.OrphanTokens)
-	if err != nil {
-		a.incrementVaultError()
-		klog.Errorf("error getting vault token for TFCloud workspace %s: %s", workspaceLogIdentifier, err.Error())
-		return
+const (
+	vaultAuthToken      = "token"
+	vaultAuthKubernetes = "kubernetes"
+	vaultAuthAppRole    = "approle"
+)
+
+func (a *App) refreshVaultToken(ctx context.Context) error {
+	switch a.Config.VaultAuth.Method {
+	case "", vaultAuthToken:
+		return a.refreshStaticVaultToken(ctx)
+	case vaultAuthKubernetes:
+		return a.refreshVaultLogin(ctx, vault.KubernetesAuth{
+			Mount:   a.Config.VaultAuth.Mount,
+			Role:    a.Config.VaultAuth.Role,
+			JWTFile: a.Config.VaultAuth.JWTFile,
+		})
+	case vaultAuthAppRole:
+		return a.refreshVaultLogin(ctx, vault.AppRoleAuth{
+			Mount:        a.Config.VaultAuth.Mount,
+			RoleIDFile:   a.Config.VaultAuth.RoleIDFile,
+			SecretIDFile: a.Config.VaultAuth.SecretIDFile,
+		})
+	default:
+		return fmt.Errorf("unknown vault auth method %s", a.Config.VaultAuth.Method)
 	}
-	klog.V(10).Infof("got token %v for tfcloud workspace %s", token.Auth.ClientToken, workspaceLogIdentifier)
-	klog.Infof("setting env var %s to vault token value", a.Config.TokenVariable)
-	tokenVar := tfcloud.Variable{
-		Key:       a.Config.TokenVariable,
-		Value:     token.Auth.ClientToken,
-		Token:     a.TFCloudToken,
-		Sensitive: true,
-		Workspace: instance.Workspace,
-	}
-	if err := tokenVar.Update(); err != nil {
-		a.incrementTfCloudError()
-		klog.Errorf("error updating token for TFCloud workspace %s: %s", workspaceLogIdentifier, err.Error())
-		return
+}
+
+// refreshVaultLogin logs in with the auth method on the first run, and then
+// re-uses the same client, logging in again when the token nears expiry or can
+// no longer look itself up
+func (a *App) refreshVaultLogin(ctx context.Context, auth vault.AuthMethod) error {
+	if a.VaultClient == nil {
+		client, err := vault.NewClientWithAuth(ctx, a.Config.VaultAddress, auth)
+		if err != nil {
+			return err
+		}
+		a.VaultClient = client
 	}
-	addressVar := tfcloud.Variable{
-		Key:                 "VAULT_ADDR",
-		Value:               a.Config.VaultAddress,
-		Sensitive:           false,
-		Token:               a.TFCloudToken,
-		Workspace:           instance.Workspace,
-		WorkspaceIdentifier: workspaceLogIdentifier,
-	}
-	if err := addressVar.Update(); err != nil {
-		a.incrementTfCloudError()
-		klog.Errorf("error updating VAULT_ADDR for ws %s: %s", workspaceLogIdentifier, err.Error())
-		return
+	if err := a.VaultClient.LoginIfExpiring(ctx); err != nil {
+		return err
 	}
-	if a.EnableMetrics {
-		a.Metrics.tfcloudTokensUpdated.Inc()
+	if err := a.VaultClient.LookupSelf(ctx); err != nil {
+		// The token may have been revoked or expired early, so try a fresh login
+		// before giving up on this loop
+		klog.Warningf("current token was unable to lookup self, logging in again: %s", err.Error())
+		if err := a.VaultClient.Login(ctx); err != nil {
+			return err
+		}
+		if err := a.VaultClient.LookupSelf(ctx); err != nil {
+			klog.V(4).Infof("error looking up self: %s", err.Error())
+			return fmt.Errorf("token from a fresh login was unable to lookup self, assuming invalid")
+		}
 	}
+	return nil
 }
 
-func (a *App) refreshVaultToken() error {
+func (a *App) refreshStaticVaultToken(ctx context.Context) error {
 	var client *vault.Client
 	if a.VaultTokenFile != "" {
 		klog.V(3).Infof("attempting to refresh token from file")
@@ -328,7 +874,7 @@ func (a *App) refreshVaultToken() error {
 			return err
 		}
 	}
-	if err := client.LookupSelf(); err != nil {
+	if err := client.LookupSelf(ctx); err != nil {
 		klog.V(4).Infof("error looking up self: %s", err.Error())
 		return fmt.Errorf("current token was unable to lookup self, assuming invalid")
 	}
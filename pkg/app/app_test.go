@@ -1,13 +1,119 @@
 package app
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/fairwindsops/vault-token-injector/pkg/leader"
 	"github.com/fairwindsops/vault-token-injector/pkg/spacelift"
+	"github.com/fairwindsops/vault-token-injector/pkg/state"
+	"github.com/fairwindsops/vault-token-injector/pkg/target"
+	"github.com/fairwindsops/vault-token-injector/pkg/vault"
 	"github.com/stretchr/testify/assert"
 )
 
+// fakeVault is a vault server that creates tokens with numbered accessors and
+// records the accessors that are revoked
+type fakeVault struct {
+	*httptest.Server
+	lock    sync.Mutex
+	created []string
+	revoked []string
+	// revokeStatus is returned by revocations when set
+	revokeStatus int
+}
+
+func newFakeVault(t *testing.T) *fakeVault {
+	v := &fakeVault{}
+	v.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/v1/auth/token/lookup-self":
+			w.Write([]byte(`{"data": {"id": "root"}}`))
+		case r.URL.Path == "/v1/auth/token/revoke-accessor":
+			if v.revokeStatus != 0 {
+				w.WriteHeader(v.revokeStatus)
+				w.Write([]byte(`{"errors": ["revoke failed"]}`))
+				return
+			}
+			var body struct {
+				Accessor string `json:"accessor"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			v.revoked = append(v.revoked, body.Accessor)
+			w.WriteHeader(http.StatusNoContent)
+		case strings.HasPrefix(r.URL.Path, "/v1/auth/token/create"):
+			accessor := fmt.Sprintf("accessor-%d", len(v.created)+1)
+			v.created = append(v.created, accessor)
+			fmt.Fprintf(w, `{"auth": {"client_token": "token-%d", "accessor": %q, "lease_duration": 3600}}`, len(v.created), accessor)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(v.Close)
+	return v
+}
+
+func (v *fakeVault) client(t *testing.T) *vault.Client {
+	client, err := vault.NewClient(v.URL, "root")
+	assert.NoError(t, err)
+	return client
+}
+
+func (v *fakeVault) revocations() []string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return append([]string(nil), v.revoked...)
+}
+
+// fakeTarget records the variables written to it
+type fakeTarget struct {
+	name string
+	err  error
+	// partial writes the token before failing with err
+	partial bool
+	vars    *[]target.Variable
+}
+
+func (t fakeTarget) Provider() string                  { return "fake" }
+func (t fakeTarget) Name() string                      { return t.name }
+func (t fakeTarget) Validate() error                   { return nil }
+func (t fakeTarget) TokenOptions() target.TokenOptions { return target.TokenOptions{} }
+func (t fakeTarget) SetVariables(ctx context.Context, vars []target.Variable) error {
+	if t.err != nil {
+		if t.partial {
+			*t.vars = vars[:1]
+		}
+		return t.err
+	}
+	*t.vars = vars
+	return nil
+}
+
+type fakeProvider struct {
+	name    string
+	targets []target.Target
+}
+
+func (p fakeProvider) Name() string {
+	return p.name
+}
+
+func (p fakeProvider) Targets(ctx context.Context) ([]target.Target, error) {
+	return p.targets, nil
+}
+
 func TestNewApp(t *testing.T) {
 	type args struct {
 		circleToken     string
@@ -37,6 +143,8 @@ func TestNewApp(t *testing.T) {
 					TokenVariable:        "VAULT_TOKEN",
 					TokenTTL:             time.Minute * 60,
 					TokenRefreshInterval: time.Minute * 30,
+					RefreshStaggerWindow: time.Minute * 30,
+					ShutdownTimeout:      time.Second * 30,
 				},
 			},
 		},
@@ -58,14 +166,238 @@ func TestNewApp(t *testing.T) {
 					TokenVariable:        "FOO",
 					TokenTTL:             time.Minute * 60,
 					TokenRefreshInterval: time.Minute * 30,
+					RefreshStaggerWindow: time.Minute * 30,
+					ShutdownTimeout:      time.Second * 30,
 				},
 			},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := NewApp(tt.args.circleToken, tt.args.vaultTokenFile, tt.args.tfCloudToken, tt.args.config, false, tt.args.spaceliftClient)
+			got := NewApp(tt.args.circleToken, tt.args.vaultTokenFile, tt.args.tfCloudToken, tt.args.config, false, tt.args.spaceliftClient, nil, nil)
 			assert.EqualValues(t, tt.want, got)
 		})
 	}
 }
+
+func TestTokenSettings(t *testing.T) {
+	role := "role"
+	orphan := true
+	notOrphan := false
+	a := &App{
+		Config: &Config{
+			TokenVariable:        "VAULT_TOKEN",
+			TokenTTL:             time.Minute * 60,
+			TokenRefreshInterval: time.Minute * 30,
+			OrphanTokens:         true,
+		},
+	}
+	tests := []struct {
+		name string
+		opts target.TokenOptions
+		want target.TokenOptions
+	}{
+		{
+			name: "defaults",
+			opts: target.TokenOptions{VaultRole: &role},
+			want: target.TokenOptions{
+				VaultRole:       &role,
+				TTL:             time.Minute * 60,
+				RefreshInterval: time.Minute * 30,
+				TokenVariable:   "VAULT_TOKEN",
+				Orphan:          &orphan,
+			},
+		},
+		{
+			name: "overrides",
+			opts: target.TokenOptions{
+				VaultPolicies:   []string{"a"},
+				TTL:             time.Hour * 4,
+				RefreshInterval: time.Hour,
+				TokenVariable:   "TF_VAR_vault_token",
+				Orphan:          &notOrphan,
+			},
+			want: target.TokenOptions{
+				VaultPolicies:   []string{"a"},
+				TTL:             time.Hour * 4,
+				RefreshInterval: time.Hour,
+				TokenVariable:   "TF_VAR_vault_token",
+				Orphan:          &notOrphan,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.EqualValues(t, tt.want, a.tokenSettings(tt.opts))
+		})
+	}
+}
+
+func TestWorkContext(t *testing.T) {
+	a := &App{Config: &Config{ShutdownTimeout: time.Millisecond * 50}}
+	ctx, cancelRun := context.WithCancel(context.Background())
+	workCtx, cancel := a.workContext(ctx)
+	defer cancel()
+
+	cancelRun()
+	// In-flight work keeps running until the shutdown timeout has passed
+	assert.NoError(t, workCtx.Err())
+	select {
+	case <-workCtx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("work context was not cancelled after the shutdown timeout")
+	}
+
+	// Losing leadership cancels in-flight work straight away
+	a.Config.ShutdownTimeout = time.Hour
+	leadCtx, cancelLead := context.WithCancelCause(context.Background())
+	workCtx, cancel = a.workContext(leadCtx)
+	defer cancel()
+	cancelLead(leader.ErrLostLeadership)
+	select {
+	case <-workCtx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("work context was not cancelled after leadership was lost")
+	}
+}
+
+func TestFreshUntil(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+	a := &App{Config: &Config{TokenTTL: time.Hour, TokenRefreshInterval: time.Minute * 30}}
+	ws := tfCloudTarget{config: TFCloudConfig{Workspace: "ws-123"}}
+	settings := a.tokenSettingsHash(a.tokenSettings(ws.TokenOptions()))
+	role := "admin"
+	changed := a.tokenSettingsHash(a.tokenSettings(target.TokenOptions{VaultRole: &role}))
+
+	tests := []struct {
+		name      string
+		threshold float64
+		record    state.Record
+		want      time.Time
+	}{
+		{
+			name:   "no record",
+			record: state.Record{},
+			want:   time.Time{},
+		},
+		{
+			name:   "refresh interval",
+			record: state.Record{LastSuccess: now, ExpiresAt: now.Add(time.Hour)},
+			want:   now.Add(time.Minute * 30),
+		},
+		{
+			name:      "rotation threshold",
+			threshold: 0.75,
+			record:    state.Record{LastSuccess: now, ExpiresAt: now.Add(time.Hour)},
+			want:      now.Add(time.Minute * 45),
+		},
+		{
+			name:   "expires first",
+			record: state.Record{LastSuccess: now, ExpiresAt: now.Add(time.Minute * 10)},
+			want:   now.Add(time.Minute * 9),
+		},
+		{
+			name:      "expiry margin is capped",
+			threshold: 1,
+			record:    state.Record{LastSuccess: now, ExpiresAt: now.Add(time.Hour)},
+			want:      now.Add(time.Minute * 55),
+		},
+		{
+			name:   "same settings",
+			record: state.Record{LastSuccess: now, ExpiresAt: now.Add(time.Hour), TokenSettings: settings},
+			want:   now.Add(time.Minute * 30),
+		},
+		{
+			name:   "settings changed",
+			record: state.Record{LastSuccess: now, ExpiresAt: now.Add(time.Hour), TokenSettings: changed},
+			want:   time.Time{},
+		},
+		{
+			name:   "failed since",
+			record: state.Record{LastSuccess: now, ExpiresAt: now.Add(time.Hour), LastError: "boom", LastErrorTime: now.Add(time.Minute)},
+			want:   time.Time{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a.Config.RotationThreshold = tt.threshold
+			assert.Equal(t, tt.want, a.freshUntil(tt.record, ws))
+		})
+	}
+}
+
+func TestUpdateTarget(t *testing.T) {
+	v := newFakeVault(t)
+	a := &App{
+		Config: &Config{
+			VaultAddress:         v.URL,
+			TokenVariable:        "VAULT_TOKEN",
+			TokenTTL:             time.Hour,
+			TokenRefreshInterval: time.Minute * 30,
+		},
+		VaultClient: v.client(t),
+	}
+
+	var vars []target.Variable
+	var wg sync.WaitGroup
+	wg.Add(1)
+	a.updateTarget(context.Background(), fakeTarget{name: "ok", vars: &vars}, &wg)
+	assert.Equal(t, []target.Variable{
+		{Key: "VAULT_TOKEN", Value: "token-1", Sensitive: true},
+		{Key: "VAULT_ADDR", Value: v.URL},
+	}, vars)
+
+	wg.Add(1)
+	a.updateTarget(context.Background(), fakeTarget{name: "broken", err: errors.New("boom"), vars: &vars}, &wg)
+	assert.Len(t, v.created, 2, "a token is created before writing to the target")
+}
+
+func TestWithRegistered(t *testing.T) {
+	builtIn := []target.Provider{
+		staticProvider{name: providerCircleCI},
+		staticProvider{name: providerGitLab},
+	}
+	replacement := fakeProvider{name: providerGitLab}
+	vercel := fakeProvider{name: "vercel"}
+	assert.Equal(t, []target.Provider{
+		staticProvider{name: providerCircleCI},
+		replacement,
+		vercel,
+	}, withRegistered(builtIn, []target.Provider{replacement, vercel}), "a registered provider replaces the built-in one")
+}
+
+func TestRefreshVaultLogin(t *testing.T) {
+	dir := t.TempDir()
+	secretIDFile := dir + "/secret-id"
+	assert.NoError(t, os.WriteFile(secretIDFile, []byte("secret-1"), 0600))
+
+	// The first token is revoked after login, so looking it up fails, and the
+	// secret_id is rotated in the meantime
+	var logins []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/auth/approle/login":
+			var body map[string]string
+			json.NewDecoder(r.Body).Decode(&body)
+			logins = append(logins, body["secret_id"])
+			os.WriteFile(secretIDFile, []byte("secret-2"), 0600)
+			fmt.Fprintf(w, `{"auth": {"client_token": "token-%d", "lease_duration": 3600}}`, len(logins))
+		case "/v1/auth/token/lookup-self":
+			if r.Header.Get("X-Vault-Token") == "token-1" {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(`{"errors": ["permission denied"]}`))
+				return
+			}
+			w.Write([]byte(`{"data": {"id": "token-2"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv("VAULT_ROLE_ID", "role")
+	a := &App{Config: &Config{VaultAddress: server.URL}}
+	assert.NoError(t, a.refreshVaultLogin(context.Background(), vault.AppRoleAuth{SecretIDFile: secretIDFile}))
+	assert.Equal(t, []string{"secret-1", "secret-2"}, logins, "logs in again with the rotated secret_id when lookup-self fails")
+}
@@ -0,0 +1,287 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-viper/mapstructure/v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/fairwindsops/vault-token-injector/pkg/crd"
+	"github.com/fairwindsops/vault-token-injector/pkg/target"
+	"github.com/fairwindsops/vault-token-injector/pkg/vault"
+)
+
+// providerController is the name of the provider of targets declared as resources
+const providerController = "controller"
+
+// injectionTargetFields are the fields a resource may set in its target for each
+// provider. Fields that point the injector at another API, such as url, are left
+// out, so that a resource cannot send provider credentials to a server of its choosing.
+var injectionTargetFields = map[string][]string{
+	providerCircleCI:  {"name", "context", "organization", "vcs_type"},
+	providerTFCloud:   {"workspace", "variable_set", "organization", "workspace_tags", "project_tags", "name"},
+	providerSpacelift: {"stack", "context"},
+	providerGitHub:    {"repository", "environment", "organization", "visibility", "selected_repository_ids"},
+	providerGitLab:    {"project", "group", "protected"},
+}
+
+// statusReporter is implemented by targets that report the outcome of each injection
+type statusReporter interface {
+	reportSuccess(ctx context.Context, now time.Time, token *vault.Token)
+	reportError(ctx context.Context, now time.Time, err error)
+}
+
+// minInjectionInterval is the shortest token TTL or refresh interval a resource may ask for
+const minInjectionInterval = time.Minute
+
+// controllerProvider lists the targets declared as VaultTokenInjection resources
+type controllerProvider struct {
+	app    *App
+	client *crd.Client
+	// reserved are the destinations of the targets of the other providers, which
+	// resources cannot also declare, along with where each comes from. It is filled
+	// in as the other providers are listed, so the controller must be listed last.
+	reserved map[string]string
+	// dryRun returns invalid resources as errors instead of writing to their status
+	dryRun bool
+}
+
+func (p controllerProvider) Name() string {
+	return providerController
+}
+
+// Targets returns a target for each valid resource in the configured namespaces.
+// Invalid resources, and resources that declare a target that is already
+// declared, have the problem written to their status instead, or returned as an
+// error in a dry run. The oldest resource declaring a target wins.
+func (p controllerProvider) Targets(ctx context.Context) ([]target.Target, error) {
+	var targets []target.Target
+	var errs []error
+	declaredBy := map[string]string{}
+	for _, namespace := range p.app.Config.Controller.Namespaces {
+		injections, err := p.client.List(ctx, namespace.Namespace)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, injection := range injections {
+			resource := fmt.Sprintf("%s/%s", injection.Namespace, injection.Name)
+			t, err := p.app.newInjectionTarget(injection, namespace, p.client)
+			if err == nil {
+				id := destination(t)
+				if source, ok := p.reserved[id]; ok {
+					err = fmt.Errorf("target %s is already configured in %s", id, source)
+				} else if other, ok := declaredBy[id]; ok {
+					err = fmt.Errorf("target %s is already declared by %s", id, other)
+				} else {
+					declaredBy[id] = resource
+				}
+			}
+			if err != nil && p.dryRun {
+				errs = append(errs, fmt.Errorf("invalid %s %s: %w", crd.Kind, resource, err))
+				continue
+			}
+			if err != nil {
+				klog.Errorf("invalid %s %s: %s", crd.Kind, resource, err.Error())
+				p.reportInvalid(ctx, injection, err)
+				continue
+			}
+			targets = append(targets, t)
+		}
+	}
+	return targets, errors.Join(errs...)
+}
+
+// reportInvalid writes the problem with a resource to its status, unless it is already there
+func (p controllerProvider) reportInvalid(ctx context.Context, injection crd.VaultTokenInjection, err error) {
+	if injection.Status.LastError == err.Error() && injection.Status.ObservedGeneration == injection.Generation {
+		return
+	}
+	now := metav1.Now()
+	updateErr := p.client.UpdateStatus(ctx, injection.Namespace, injection.Name, func(status *crd.VaultTokenInjectionStatus) {
+		status.Target = ""
+		status.LastError = err.Error()
+		status.LastErrorTime = &now
+	})
+	if updateErr != nil {
+		klog.Errorf("could not update the status of %s %s/%s: %s", crd.Kind, injection.Namespace, injection.Name, updateErr.Error())
+	}
+}
+
+// newInjectionTarget builds the target declared by a resource, making sure it only
+// uses the vault roles and policies allowed in its namespace, only asks for orphan
+// tokens if the namespace allows them, and has the same valid token settings as a
+// target in the config file
+func (a *App) newInjectionTarget(injection crd.VaultTokenInjection, namespace ControllerNamespaceConfig, client *crd.Client) (target.Target, error) {
+	spec := injection.Spec
+	if spec.VaultRole == nil && len(spec.VaultPolicies) == 0 {
+		return nil, fmt.Errorf("neither vaultRole nor vaultPolicies is set")
+	}
+	if spec.VaultRole != nil && !slices.Contains(namespace.VaultRoles, *spec.VaultRole) {
+		return nil, fmt.Errorf("vault role %s is not allowed in namespace %s", *spec.VaultRole, namespace.Namespace)
+	}
+	for _, policy := range spec.VaultPolicies {
+		if !slices.Contains(namespace.VaultPolicies, policy) {
+			return nil, fmt.Errorf("vault policy %s is not allowed in namespace %s", policy, namespace.Namespace)
+		}
+	}
+	if spec.OrphanTokens != nil && *spec.OrphanTokens && !namespace.AllowOrphanTokens {
+		return nil, fmt.Errorf("orphan tokens are not allowed in namespace %s", namespace.Namespace)
+	}
+	for _, d := range []struct {
+		field string
+		value *metav1.Duration
+	}{
+		{"tokenTTL", spec.TokenTTL},
+		{"tokenRefreshInterval", spec.TokenRefreshInterval},
+	} {
+		if d.value != nil && d.value.Duration < minInjectionInterval {
+			return nil, fmt.Errorf("%s must be at least %s, got %s", d.field, minInjectionInterval.String(), d.value.Duration.String())
+		}
+	}
+	fields, ok := injectionTargetFields[spec.Provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %q", spec.Provider)
+	}
+	for field := range spec.Target {
+		if !slices.Contains(fields, field) {
+			return nil, fmt.Errorf("unknown field %q in target, the %s provider supports %v", field, spec.Provider, fields)
+		}
+	}
+
+	overrides := TokenOverrides{
+		TokenVariable: spec.TokenVariable,
+		OrphanTokens:  spec.OrphanTokens,
+	}
+	if spec.TokenTTL != nil {
+		overrides.TokenTTL = spec.TokenTTL.Duration
+	}
+	if spec.TokenRefreshInterval != nil {
+		overrides.TokenRefreshInterval = spec.TokenRefreshInterval.Duration
+	}
+
+	var t target.Target
+	var err error
+	switch spec.Provider {
+	case providerCircleCI:
+		config := CircleCIConfig{VaultRole: spec.VaultRole, VaultPolicies: spec.VaultPolicies, TokenOverrides: overrides}
+		err = decodeInjectionTarget(spec.Target, &config)
+		t = a.newCircleCITarget(config)
+	case providerTFCloud:
+		config := TFCloudConfig{VaultRole: spec.VaultRole, VaultPolicies: spec.VaultPolicies, TokenOverrides: overrides}
+		err = decodeInjectionTarget(spec.Target, &config)
+		t = a.newTFCloudTarget(config)
+	case providerSpacelift:
+		config := SpaceliftConfig{VaultRole: spec.VaultRole, VaultPolicies: spec.VaultPolicies, TokenOverrides: overrides}
+		err = decodeInjectionTarget(spec.Target, &config)
+		t = spaceliftTarget{config: config, client: a.SpaceliftClient}
+	case providerGitHub:
+		config := GitHubConfig{VaultRole: spec.VaultRole, VaultPolicies: spec.VaultPolicies, TokenOverrides: overrides}
+		err = decodeInjectionTarget(spec.Target, &config)
+		t = gitHubTarget{config: config, client: a.GitHubClient}
+	case providerGitLab:
+		config := GitLabConfig{VaultRole: spec.VaultRole, VaultPolicies: spec.VaultPolicies, TokenOverrides: overrides}
+		err = decodeInjectionTarget(spec.Target, &config)
+		t = gitLabTarget{config: config, client: a.GitLabClient}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	var problems []string
+	a.checkTokenSettings("", t.TokenOptions(), spec.VaultRole, spec.VaultPolicies, func(_, format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	})
+	if len(problems) > 0 {
+		return nil, errors.New(strings.Join(problems, ", "))
+	}
+	return injectionTarget{Target: t, namespace: injection.Namespace, name: injection.Name, client: client}, nil
+}
+
+// decodeInjectionTarget decodes the target of a resource into a provider's config
+func decodeInjectionTarget(fields map[string]interface{}, config interface{}) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{Result: config})
+	if err != nil {
+		return err
+	}
+	if err := decoder.Decode(fields); err != nil {
+		return fmt.Errorf("invalid target: %s", err.Error())
+	}
+	return nil
+}
+
+// injectionTarget is a target declared by a VaultTokenInjection resource. It writes
+// the outcome of each injection to the status of the resource.
+type injectionTarget struct {
+	target.Target
+	namespace string
+	name      string
+	client    *crd.Client
+}
+
+// Check checks the declared target. Every built-in target is a target.Checker
+func (t injectionTarget) Check(ctx context.Context) error {
+	checker, ok := t.Target.(target.Checker)
+	if !ok {
+		return nil
+	}
+	return checker.Check(ctx)
+}
+
+func (t injectionTarget) reportSuccess(ctx context.Context, now time.Time, token *vault.Token) {
+	t.updateStatus(ctx, func(status *crd.VaultTokenInjectionStatus) {
+		injected := metav1.NewTime(now)
+		expires := metav1.NewTime(now.Add(time.Duration(token.Data.TTL) * time.Second))
+		status.LastInjectionTime = &injected
+		status.ExpiresAt = &expires
+		status.LastError = ""
+		status.LastErrorTime = nil
+	})
+}
+
+func (t injectionTarget) reportError(ctx context.Context, now time.Time, err error) {
+	t.updateStatus(ctx, func(status *crd.VaultTokenInjectionStatus) {
+		failed := metav1.NewTime(now)
+		status.LastError = err.Error()
+		status.LastErrorTime = &failed
+	})
+}
+
+// updateStatus updates the status of the resource. Failing to update it is logged
+// but does not fail the injection.
+func (t injectionTarget) updateStatus(ctx context.Context, fn func(*crd.VaultTokenInjectionStatus)) {
+	err := t.client.UpdateStatus(ctx, t.namespace, t.name, func(status *crd.VaultTokenInjectionStatus) {
+		status.Target = target.ID(t)
+		fn(status)
+	})
+	if err != nil {
+		klog.Errorf("could not update the status of %s %s/%s: %s", crd.Kind, t.namespace, t.name, err.Error())
+	}
+}
+
+// reservingProvider records the destinations of the targets of a provider as they
+// are listed, so that resources cannot declare the same targets
+type reservingProvider struct {
+	target.Provider
+	reserved map[string]string
+}
+
+func (p reservingProvider) Targets(ctx context.Context) ([]target.Target, error) {
+	targets, err := p.Provider.Targets(ctx)
+	source := fmt.Sprintf("the %s provider", p.Name())
+	if _, ok := p.Provider.(staticProvider); ok {
+		source = "the config file"
+	}
+	for _, t := range targets {
+		p.reserved[destination(t)] = source
+	}
+	return targets, err
+}
@@ -0,0 +1,229 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	"github.com/fairwindsops/vault-token-injector/pkg/crd"
+	"github.com/fairwindsops/vault-token-injector/pkg/gitlab"
+	"github.com/fairwindsops/vault-token-injector/pkg/target"
+	"github.com/fairwindsops/vault-token-injector/pkg/vault"
+)
+
+func newInjection(name string, created time.Time, spec map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": crd.Group + "/" + crd.Version,
+		"kind":       crd.Kind,
+		"metadata": map[string]interface{}{
+			"name":              name,
+			"namespace":         "team-a",
+			"generation":        int64(1),
+			"creationTimestamp": created.Format(time.RFC3339),
+		},
+		"spec": spec,
+	}}
+}
+
+func TestController(t *testing.T) {
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{crd.Resource: crd.Kind + "List"},
+		newInjection("app", created, map[string]interface{}{
+			"provider":  "gitlab",
+			"target":    map[string]interface{}{"project": "group/app", "protected": true},
+			"vaultRole": "team-a",
+			"tokenTTL":  "2h",
+		}),
+		newInjection("app-again", created.Add(time.Minute), map[string]interface{}{
+			"provider":  "gitlab",
+			"target":    map[string]interface{}{"project": "group/app"},
+			"vaultRole": "team-a",
+		}),
+		newInjection("admin", created, map[string]interface{}{
+			"provider":  "gitlab",
+			"target":    map[string]interface{}{"project": "group/other"},
+			"vaultRole": "admin",
+		}),
+		newInjection("custom-url", created, map[string]interface{}{
+			"provider":      "circleci",
+			"target":        map[string]interface{}{"name": "org/repo", "url": "https://example.com"},
+			"vaultPolicies": []interface{}{"team-a"},
+		}),
+		newInjection("config-file", created, map[string]interface{}{
+			"provider":  "gitlab",
+			"target":    map[string]interface{}{"project": "group/static"},
+			"vaultRole": "team-a",
+		}),
+		newInjection("negative", created, map[string]interface{}{
+			"provider":             "gitlab",
+			"target":               map[string]interface{}{"project": "group/negative"},
+			"vaultRole":            "team-a",
+			"tokenRefreshInterval": "-1h",
+		}),
+		newInjection("short-ttl", created, map[string]interface{}{
+			"provider":  "gitlab",
+			"target":    map[string]interface{}{"project": "group/short-ttl"},
+			"vaultRole": "team-a",
+			"tokenTTL":  "10m",
+		}),
+		newInjection("orphan", created, map[string]interface{}{
+			"provider":     "gitlab",
+			"target":       map[string]interface{}{"project": "group/orphan"},
+			"vaultRole":    "team-a",
+			"orphanTokens": true,
+		}),
+		newInjection("discovered", created, map[string]interface{}{
+			"provider":  "gitlab",
+			"target":    map[string]interface{}{"project": "group/discovered"},
+			"vaultRole": "team-a",
+		}),
+	)
+
+	role := "ci"
+	a := &App{
+		Config: &Config{
+			TokenTTL:             time.Hour,
+			TokenRefreshInterval: time.Minute * 30,
+			GitLab:               []GitLabConfig{{Project: "group/static", VaultRole: &role}},
+			Controller: ControllerConfig{
+				Enabled: true,
+				Namespaces: []ControllerNamespaceConfig{
+					{Namespace: "team-a", VaultRoles: []string{"team-a"}, VaultPolicies: []string{"team-a"}},
+				},
+			},
+		},
+		GitLabClient: &gitlab.Client{Token: "token"},
+		injections:   &crd.Client{Client: client},
+	}
+	ctx := context.Background()
+
+	// The controller is listed after the other providers have reserved their targets
+	var targets []target.Target
+	for _, provider := range a.providers(false) {
+		providerTargets, err := provider.Targets(ctx)
+		assert.NoError(t, err)
+		if provider.Name() == providerController {
+			targets = providerTargets
+		}
+	}
+	assert.Len(t, targets, 2)
+	injected := targets[0]
+	assert.Equal(t, "gitlab/group/app", target.ID(injected))
+	assert.Equal(t, time.Hour*2, injected.TokenOptions().TTL)
+	assert.Equal(t, "team-a", *injected.TokenOptions().VaultRole)
+
+	status := func(name string) crd.VaultTokenInjectionStatus {
+		injections, err := a.injections.List(ctx, "team-a")
+		assert.NoError(t, err)
+		for _, injection := range injections {
+			if injection.Name == name {
+				return injection.Status
+			}
+		}
+		t.Fatalf("no injection named %s", name)
+		return crd.VaultTokenInjectionStatus{}
+	}
+	assert.Equal(t, "target gitlab/group/app is already declared by team-a/app", status("app-again").LastError)
+	assert.Equal(t, "vault role admin is not allowed in namespace team-a", status("admin").LastError)
+	assert.Contains(t, status("custom-url").LastError, `unknown field "url" in target`)
+	assert.Equal(t, "target gitlab/group/static is already configured in the config file", status("config-file").LastError)
+	assert.Equal(t, int64(1), status("admin").ObservedGeneration)
+	assert.Equal(t, "tokenRefreshInterval must be at least 1m0s, got -1h0m0s", status("negative").LastError)
+	assert.Equal(t, "token_ttl 10m0s is shorter than token_refresh_interval 30m0s, so tokens would expire before they are refreshed", status("short-ttl").LastError)
+	assert.Equal(t, "orphan tokens are not allowed in namespace team-a", status("orphan").LastError)
+
+	// Targets of discovery and registered providers are reserved too
+	reserved := map[string]string{"gitlab/group/static": "the config file"}
+	discovery := reservingProvider{Provider: fakeProvider{name: "discovery", targets: []target.Target{gitLabTarget{config: GitLabConfig{Project: "group/discovered"}}}}, reserved: reserved}
+	_, err := discovery.Targets(ctx)
+	assert.NoError(t, err)
+	targets, err = controllerProvider{app: a, client: a.injections, reserved: reserved}.Targets(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, targets, 1)
+	assert.Equal(t, "target gitlab/group/discovered is already configured in the discovery provider", status("discovered").LastError)
+
+	// A namespace can allow orphan tokens
+	a.Config.Controller.Namespaces[0].AllowOrphanTokens = true
+	targets, err = controllerProvider{app: a, client: a.injections, reserved: reserved}.Targets(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, targets, 2)
+
+	a.recordError(ctx, injected, errors.New("boom"))
+	assert.Equal(t, "boom", status("app").LastError)
+	assert.Equal(t, "gitlab/group/app", status("app").Target)
+
+	token := &vault.Token{}
+	token.Data.TTL = 7200
+	a.recordSuccess(ctx, injected, token, nil)
+	succeeded := status("app")
+	assert.Empty(t, succeeded.LastError)
+	assert.Nil(t, succeeded.LastErrorTime)
+	assert.NotNil(t, succeeded.LastInjectionTime)
+	assert.Equal(t, 2*time.Hour, succeeded.ExpiresAt.Sub(succeeded.LastInjectionTime.Time))
+}
+
+func TestControllerTFCloudDestination(t *testing.T) {
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{crd.Resource: crd.Kind + "List"},
+		newInjection("renamed", created, map[string]interface{}{
+			"provider":  "tfcloud",
+			"target":    map[string]interface{}{"workspace": "ws-1", "name": "other"},
+			"vaultRole": "team-a",
+		}),
+		newInjection("varset", created, map[string]interface{}{
+			"provider":  "tfcloud",
+			"target":    map[string]interface{}{"variable_set": "shared", "organization": "org"},
+			"vaultRole": "team-a",
+		}),
+		newInjection("varset-renamed", created.Add(time.Minute), map[string]interface{}{
+			"provider":  "tfcloud",
+			"target":    map[string]interface{}{"variable_set": "shared", "organization": "org", "name": "mine"},
+			"vaultRole": "team-a",
+		}),
+	)
+	role := "ci"
+	a := &App{
+		Config: &Config{
+			TokenTTL:             time.Hour,
+			TokenRefreshInterval: time.Minute * 30,
+			TFCloud:              []TFCloudConfig{{Workspace: "ws-1", Name: "prod", VaultRole: &role}},
+			Controller: ControllerConfig{
+				Enabled:    true,
+				Namespaces: []ControllerNamespaceConfig{{Namespace: "team-a", VaultRoles: []string{"team-a"}}},
+			},
+		},
+		TFCloudToken: "token",
+		injections:   &crd.Client{Client: client},
+	}
+	ctx := context.Background()
+
+	// A resource cannot get around the reservation by naming a workspace or variable set differently
+	var targets []target.Target
+	for _, provider := range a.providers(false) {
+		providerTargets, err := provider.Targets(ctx)
+		assert.NoError(t, err)
+		if provider.Name() == providerController {
+			targets = providerTargets
+		}
+	}
+	assert.Len(t, targets, 1)
+	assert.Equal(t, "tfcloud/varset:org/shared", target.ID(targets[0]))
+
+	injections, err := a.injections.List(ctx, "team-a")
+	assert.NoError(t, err)
+	errs := map[string]string{}
+	for _, injection := range injections {
+		errs[injection.Name] = injection.Status.LastError
+	}
+	assert.Equal(t, "target tfcloud/ws-1 is already configured in the config file", errs["renamed"])
+	assert.Equal(t, "target tfcloud/varset:org/shared is already declared by team-a/varset", errs["varset-renamed"])
+}
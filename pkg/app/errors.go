@@ -8,12 +8,16 @@ import (
 type Metrics struct {
 	totalErrorCount        prometheus.Counter
 	vaultErrorCount        prometheus.Counter
+	revokeErrorCount       prometheus.Counter
 	circleCIErrorCount     prometheus.Counter
 	circleTokensUpdated    prometheus.Counter
 	tfCloudErrorCount      prometheus.Counter
 	tfcloudTokensUpdated   prometheus.Counter
 	spaceliftErrorCount    prometheus.Counter
 	spaceliftTokensUpdated prometheus.Counter
+	targetErrorCount       *prometheus.CounterVec
+	targetTokensUpdated    *prometheus.CounterVec
+	leader                 prometheus.Gauge
 }
 
 func (a *App) registerMetrics() {
@@ -26,6 +30,10 @@ func (a *App) registerMetrics() {
 			Name: "vault_token_injector_vault_errors_total",
 			Help: "The number of errors encountered when calling the Vault API",
 		}),
+		revokeErrorCount: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "vault_token_injector_revoke_errors_total",
+			Help: "The number of replaced tokens that could not be revoked",
+		}),
 		circleCIErrorCount: promauto.NewCounter(prometheus.CounterOpts{
 			Name: "vault_token_injector_circleci_errors_total",
 			Help: "The number of errors encountered when calling the CircleCI API",
@@ -50,33 +58,100 @@ func (a *App) registerMetrics() {
 			Name: "vault_token_injector_spacelift_tokens_updated",
 			Help: "The number of Spacelift tokens updated",
 		}),
+		targetErrorCount: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "vault_token_injector_target_errors_total",
+			Help: "The number of errors encountered when updating a target, by provider",
+		}, []string{"provider"}),
+		targetTokensUpdated: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "vault_token_injector_target_tokens_updated",
+			Help: "The number of tokens updated, by provider",
+		}, []string{"provider"}),
+		leader: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "vault_token_injector_leader",
+			Help: "1 if this replica is the leader and is injecting tokens, otherwise 0",
+		}),
 	}
 }
 
-func (a App) incrementVaultError() {
+func (a *App) incrementVaultError() {
 	if a.EnableMetrics {
 		a.Metrics.vaultErrorCount.Inc()
 		a.Metrics.totalErrorCount.Inc()
 	}
 }
 
-func (a App) incrementTfCloudError() {
+// incrementRevokeError counts a token that could not be revoked. It is not a vault
+// error, as the token may simply have expired already, so it does not fail the
+// health check.
+func (a *App) incrementRevokeError() {
+	if a.EnableMetrics {
+		a.Metrics.revokeErrorCount.Inc()
+	}
+}
+
+func (a *App) incrementTfCloudError() {
 	if a.EnableMetrics {
 		a.Metrics.tfCloudErrorCount.Inc()
 		a.Metrics.totalErrorCount.Inc()
 	}
 }
 
-func (a App) incrementCircleCIError() {
+func (a *App) incrementCircleCIError() {
 	if a.EnableMetrics {
 		a.Metrics.circleCIErrorCount.Inc()
 		a.Metrics.totalErrorCount.Inc()
 	}
 }
 
-func (a App) incrementSpaceliftError() {
+func (a *App) incrementSpaceliftError() {
 	if a.EnableMetrics {
 		a.Metrics.spaceliftErrorCount.Inc()
 		a.Metrics.totalErrorCount.Inc()
 	}
 }
+
+// incrementTargetError increments the error count for a provider. The built-in
+// providers also increment their own legacy counters.
+func (a *App) incrementTargetError(provider string) {
+	switch provider {
+	case providerCircleCI:
+		a.incrementCircleCIError()
+	case providerTFCloud:
+		a.incrementTfCloudError()
+	case providerSpacelift:
+		a.incrementSpaceliftError()
+	default:
+		if a.EnableMetrics {
+			a.Metrics.totalErrorCount.Inc()
+		}
+	}
+	if a.EnableMetrics {
+		a.Metrics.targetErrorCount.WithLabelValues(provider).Inc()
+	}
+}
+
+// incrementTokensUpdated increments the tokens updated count for a provider
+func (a *App) incrementTokensUpdated(provider string) {
+	if !a.EnableMetrics {
+		return
+	}
+	switch provider {
+	case providerCircleCI:
+		a.Metrics.circleTokensUpdated.Inc()
+	case providerTFCloud:
+		a.Metrics.tfcloudTokensUpdated.Inc()
+	case providerSpacelift:
+		a.Metrics.spaceliftTokensUpdated.Inc()
+	}
+	a.Metrics.targetTokensUpdated.WithLabelValues(provider).Inc()
+}
+
+func (a *App) setLeader(leader bool) {
+	if a.EnableMetrics {
+		if leader {
+			a.Metrics.leader.Set(1)
+		} else {
+			a.Metrics.leader.Set(0)
+		}
+	}
+}
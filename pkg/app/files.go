@@ -0,0 +1,182 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// includeKey is the key that lists more config to merge in
+const includeKey = "include"
+
+// ConfigFiles is the merged config from one or more files
+type ConfigFiles struct {
+	// Files are the files that were loaded, in the order they were merged
+	Files []string
+	// Settings are the merged settings of every file, ready to be decoded into a Config
+	Settings map[string]interface{}
+}
+
+// LoadConfigFiles reads and merges the config at path, which can be a file, a
+// directory of .yaml and .yml files, or a glob. Files listed under the include key
+// of a file are merged in after it. Lists of targets, such as circleci and tfcloud,
+// are appended to each other. Any other setting can be set in more than one file
+// only if it has the same value in each, otherwise a *ValidationError listing the
+// conflicts is returned. Each file is only loaded once.
+func LoadConfigFiles(path string) (*ConfigFiles, error) {
+	loader := &configLoader{
+		loaded: map[string]bool{},
+		config: &ConfigFiles{Settings: map[string]interface{}{}},
+		setIn:  map[string]string{},
+	}
+	if err := loader.load(path, ""); err != nil {
+		return nil, err
+	}
+	if len(loader.problems) > 0 {
+		return nil, &ValidationError{Problems: loader.problems}
+	}
+	if len(loader.config.Files) == 0 {
+		return nil, fmt.Errorf("no config files found at %s", path)
+	}
+	return loader.config, nil
+}
+
+type configLoader struct {
+	// loaded is the absolute path of every file that has been loaded
+	loaded   map[string]bool
+	config   *ConfigFiles
+	problems []Problem
+	// setIn is the file each setting was first set in
+	setIn map[string]string
+}
+
+// load merges in the config at path. Relative paths are relative to the directory dir
+func (l *configLoader) load(path, dir string) error {
+	if dir != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	files, err := findConfigFiles(path)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		key, err := filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+		if l.loaded[key] {
+			continue
+		}
+		l.loaded[key] = true
+		includes, err := l.merge(file)
+		if err != nil {
+			return err
+		}
+		for _, include := range includes {
+			if err := l.load(include, filepath.Dir(file)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// findConfigFiles returns the files at path, which can be a file, a directory or a glob
+func findConfigFiles(path string) ([]string, error) {
+	var files []string
+	info, err := os.Stat(path)
+	switch {
+	case err == nil && info.IsDir():
+		for _, pattern := range []string{"*.yaml", "*.yml"} {
+			matches, err := filepath.Glob(filepath.Join(path, pattern))
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, matches...)
+		}
+		sort.Strings(files)
+	case err == nil:
+		files = []string{path}
+	case strings.ContainsAny(path, "*?["):
+		matches, err := filepath.Glob(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config glob %s: %s", path, err.Error())
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no config files match %s", path)
+		}
+		files = matches
+	default:
+		return nil, fmt.Errorf("could not read config: %s", err.Error())
+	}
+	for i, file := range files {
+		files[i] = filepath.Clean(file)
+	}
+	return files, nil
+}
+
+// merge merges the settings of a file into the config and returns the paths it includes
+func (l *configLoader) merge(file string) ([]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file: %s", err.Error())
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("could not parse config file %s: %s", file, err.Error())
+	}
+	l.config.Files = append(l.config.Files, file)
+	if len(root.Content) == 0 {
+		return nil, nil
+	}
+	document := root.Content[0]
+	if document.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("config file %s must be a map of settings", file)
+	}
+
+	var includes []string
+	settings := l.config.Settings
+	for i := 0; i+1 < len(document.Content); i += 2 {
+		key, node := document.Content[i], document.Content[i+1]
+		name := strings.ToLower(key.Value)
+		var value interface{}
+		if err := node.Decode(&value); err != nil {
+			return nil, fmt.Errorf("could not parse %s in config file %s: %s", key.Value, file, err.Error())
+		}
+		if name == includeKey {
+			// Bad values are reported by validation, which checks every file
+			if err := node.Decode(&includes); err != nil {
+				includes = nil
+			}
+			continue
+		}
+		existing, ok := settings[name]
+		if value == nil && ok {
+			continue
+		}
+		if !ok || existing == nil {
+			settings[name] = value
+			l.setIn[name] = file
+			continue
+		}
+		existingList, existingIsList := existing.([]interface{})
+		list, isList := value.([]interface{})
+		switch {
+		case existingIsList && isList:
+			settings[name] = append(existingList, list...)
+		case !reflect.DeepEqual(existing, value):
+			l.problems = append(l.problems, Problem{
+				File:    file,
+				Line:    key.Line,
+				Path:    name,
+				Message: fmt.Sprintf("is set to a different value in %s", l.setIn[name]),
+			})
+		}
+	}
+	return includes, nil
+}
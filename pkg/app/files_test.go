@@ -0,0 +1,63 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfigFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		assert.NoError(t, os.WriteFile(path, []byte(contents), 0o644))
+		return path
+	}
+	base := writeFile("config/base.yaml", `vault_address: https://vault.example.com
+include:
+  - ../teams/*.yaml
+  - base.yaml
+circleci:
+  - name: base
+`)
+	teamA := writeFile("teams/a.yaml", `vault_address: https://vault.example.com
+circleci:
+  - name: a
+tfcloud:
+  - workspace: ws-a
+`)
+	teamB := writeFile("teams/b.yaml", `circleci:
+  - name: b
+`)
+	writeFile("teams/notes.txt", `not config`)
+
+	files, err := LoadConfigFiles(filepath.Join(dir, "config"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{base, teamA, teamB}, files.Files)
+	assert.Equal(t, map[string]interface{}{
+		"vault_address": "https://vault.example.com",
+		"circleci": []interface{}{
+			map[string]interface{}{"name": "base"},
+			map[string]interface{}{"name": "a"},
+			map[string]interface{}{"name": "b"},
+		},
+		"tfcloud": []interface{}{
+			map[string]interface{}{"workspace": "ws-a"},
+		},
+	}, files.Settings)
+
+	conflict := writeFile("teams/c.yaml", `vault_address: https://other-vault.example.com
+`)
+	_, err = LoadConfigFiles(base)
+	var validationErr *ValidationError
+	assert.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, []Problem{
+		{File: conflict, Line: 1, Path: "vault_address", Message: "is set to a different value in " + base},
+	}, validationErr.Problems)
+
+	_, err = LoadConfigFiles(filepath.Join(dir, "missing", "*.yaml"))
+	assert.Error(t, err)
+}
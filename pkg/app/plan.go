@@ -0,0 +1,92 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/fairwindsops/vault-token-injector/pkg/target"
+)
+
+// Plan prints what would be injected into every target without creating tokens or
+// writing anything. It authenticates to vault, validates each target, and checks
+// that targets which support it exist and can be read. It returns an error
+// if vault authentication, listing targets, or any target would fail.
+func (a *App) Plan(ctx context.Context, w io.Writer) error {
+	if err := a.refreshVaultToken(ctx); err != nil {
+		return fmt.Errorf("unable to authenticate to vault: %w", err)
+	}
+	fmt.Fprintf(w, "authenticated to vault at %s\n\n", a.Config.VaultAddress)
+
+	var targets []target.Target
+	problems := 0
+	for _, provider := range a.providers(true) {
+		providerTargets, err := provider.Targets(ctx)
+		if err != nil {
+			problems++
+			fmt.Fprintf(w, "! error listing targets for provider %s: %s\n\n", provider.Name(), err.Error())
+		}
+		targets = append(targets, providerTargets...)
+	}
+	sort.SliceStable(targets, func(i, j int) bool {
+		return target.ID(targets[i]) < target.ID(targets[j])
+	})
+
+	for _, t := range targets {
+		if !a.planTarget(ctx, w, t) {
+			problems++
+		}
+	}
+
+	fmt.Fprintf(w, "%d targets, %d problems\n", len(targets), problems)
+	if problems > 0 {
+		return fmt.Errorf("the plan found %d problems", problems)
+	}
+	return nil
+}
+
+// planTarget prints what would be injected into a single target and returns false
+// if the target is invalid or fails its check
+func (a *App) planTarget(ctx context.Context, w io.Writer, t target.Target) bool {
+	opts := a.tokenSettings(t.TokenOptions())
+	role := "-"
+	if opts.VaultRole != nil {
+		role = *opts.VaultRole
+	}
+	policies := "-"
+	if len(opts.VaultPolicies) > 0 {
+		policies = strings.Join(opts.VaultPolicies, ", ")
+	}
+
+	fmt.Fprintf(w, "+ %s\n", target.ID(t))
+	fmt.Fprintf(w, "    vault role:     %s\n", role)
+	fmt.Fprintf(w, "    vault policies: %s\n", policies)
+	fmt.Fprintf(w, "    token ttl:      %s, refreshed every %s\n", opts.TTL.String(), opts.RefreshInterval.String())
+	fmt.Fprintf(w, "    orphan token:   %t\n", *opts.Orphan)
+	for _, v := range a.targetVariables(opts, "") {
+		value := v.Value
+		if v.Sensitive {
+			value = "(new vault token, sensitive)"
+		}
+		fmt.Fprintf(w, "    set %s = %s\n", v.Key, value)
+	}
+
+	ok := true
+	if err := t.Validate(); err != nil {
+		fmt.Fprintf(w, "    ! invalid: %s\n", err.Error())
+		ok = false
+	} else if checker, isChecker := t.(target.Checker); isChecker {
+		if err := checker.Check(ctx); err != nil {
+			fmt.Fprintf(w, "    ! check failed: %s\n", err.Error())
+			ok = false
+		} else {
+			fmt.Fprintf(w, "    target exists and is readable\n")
+		}
+	} else {
+		fmt.Fprintf(w, "    target was not checked, the %s provider does not support checks\n", t.Provider())
+	}
+	fmt.Fprintln(w)
+	return ok
+}
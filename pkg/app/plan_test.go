@@ -0,0 +1,111 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	"github.com/fairwindsops/vault-token-injector/pkg/crd"
+	"github.com/fairwindsops/vault-token-injector/pkg/gitlab"
+)
+
+func TestPlan(t *testing.T) {
+	var created bool
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/auth/token/lookup-self" {
+			created = true
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data": {"id": "root"}}`))
+	}))
+	defer vault.Close()
+	gitlabServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			created = true
+		}
+		if r.URL.EscapedPath() == "/api/v4/projects/group%2Fmissing/variables" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer gitlabServer.Close()
+	t.Setenv("VAULT_TOKEN", "root")
+
+	role := "ci"
+	a := &App{
+		Config: &Config{
+			VaultAddress:         vault.URL,
+			TokenVariable:        "VAULT_TOKEN",
+			TokenTTL:             time.Hour,
+			TokenRefreshInterval: time.Minute * 30,
+			GitLab: []GitLabConfig{
+				{Project: "group/project", VaultRole: &role},
+				{Project: "group/missing", VaultPolicies: []string{"a", "b"}},
+			},
+		},
+		GitLabClient: &gitlab.Client{Token: "token", URL: gitlabServer.URL},
+	}
+
+	out := &bytes.Buffer{}
+	err := a.Plan(context.Background(), out)
+	assert.EqualError(t, err, "the plan found 1 problems")
+	assert.False(t, created, "the plan must not create tokens or write variables")
+	assert.Contains(t, out.String(), "+ gitlab/group/project\n    vault role:     ci\n")
+	assert.Contains(t, out.String(), "    vault policies: a, b\n")
+	assert.Contains(t, out.String(), "    set VAULT_TOKEN = (new vault token, sensitive)\n")
+	assert.Contains(t, out.String(), "    set VAULT_ADDR = "+vault.URL+"\n")
+	assert.Contains(t, out.String(), "    ! check failed: failed reading variables of GitLab project group/missing. Status Code returned: 404\n")
+	assert.Contains(t, out.String(), "    target exists and is readable\n")
+	assert.Contains(t, out.String(), "2 targets, 1 problems\n")
+}
+
+func TestPlanInvalidInjection(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data": {"id": "root"}}`))
+	}))
+	defer vault.Close()
+	t.Setenv("VAULT_TOKEN", "root")
+
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{crd.Resource: crd.Kind + "List"},
+		newInjection("admin", time.Now(), map[string]interface{}{
+			"provider":  "gitlab",
+			"target":    map[string]interface{}{"project": "group/app"},
+			"vaultRole": "admin",
+		}),
+	)
+	a := &App{
+		Config: &Config{
+			VaultAddress:         vault.URL,
+			TokenVariable:        "VAULT_TOKEN",
+			TokenTTL:             time.Hour,
+			TokenRefreshInterval: time.Minute * 30,
+			Controller: ControllerConfig{
+				Enabled:    true,
+				Namespaces: []ControllerNamespaceConfig{{Namespace: "team-a", VaultRoles: []string{"team-a"}}},
+			},
+		},
+		GitLabClient: &gitlab.Client{Token: "token"},
+		injections:   &crd.Client{Client: client},
+	}
+
+	// The problem is part of the plan, and is not written to the resource's status
+	out := &bytes.Buffer{}
+	err := a.Plan(context.Background(), out)
+	assert.EqualError(t, err, "the plan found 1 problems")
+	assert.Contains(t, out.String(), "! error listing targets for provider controller: invalid VaultTokenInjection team-a/admin: vault role admin is not allowed in namespace team-a\n")
+	for _, action := range client.Actions() {
+		assert.NotEqual(t, "update", action.GetVerb(), "the plan must not write the status of %s", crd.Kind)
+	}
+	assert.NotEmpty(t, client.Actions())
+}
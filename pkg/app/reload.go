@@ -0,0 +1,132 @@
+package app
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/fairwindsops/vault-token-injector/pkg/target"
+)
+
+// Reload validates a new config and hands it to Run, which swaps it in at its next
+// scheduling point, once no token injections are in flight. The files the config
+// was merged from are only used to report the positions of problems. An invalid config is rejected and the
+// current config is kept. Only the latest config is kept if Reload is called again
+// before Run picks it up.
+func (a *App) Reload(config *Config, files ...string) error {
+	setDefaults(config)
+	candidate := &App{
+		Config:          config,
+		CircleToken:     a.CircleToken,
+		TFCloudToken:    a.TFCloudToken,
+		SpaceliftClient: a.SpaceliftClient,
+		GitHubClient:    a.GitHubClient,
+		GitLabClient:    a.GitLabClient,
+	}
+	if err := candidate.Validate(files...); err != nil {
+		return err
+	}
+	reloads := a.reloadChannel()
+	for {
+		select {
+		case reloads <- config:
+			return nil
+		default:
+			// Drop the config that has not been picked up yet in favour of this one
+			select {
+			case <-reloads:
+			default:
+			}
+		}
+	}
+}
+
+func (a *App) reloadChannel() chan *Config {
+	a.reloadOnce.Do(func() {
+		a.reloads = make(chan *Config, 1)
+	})
+	return a.reloads
+}
+
+// pendingReload returns the config passed to Reload that has not been applied yet, if there is one
+func (a *App) pendingReload() *Config {
+	select {
+	case config := <-a.reloadChannel():
+		return config
+	default:
+		return nil
+	}
+}
+
+// waitUntil waits until the given time or until the context is done. It returns
+// early with the new config if one is reloaded in the meantime.
+func (a *App) waitUntil(ctx context.Context, t time.Time) *Config {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	case config := <-a.reloadChannel():
+		return config
+	}
+	return nil
+}
+
+// applyConfig swaps in a reloaded config. It must only be called when no token
+// injections are in flight. Settings that are only read on startup are kept from
+// the current config until the next restart.
+func (a *App) applyConfig(config *Config, sched *scheduler) {
+	current := a.Config
+	if config.LeaderElection != current.LeaderElection {
+		klog.Warning("leader_election changed, the change will take effect on the next restart")
+		config.LeaderElection = current.LeaderElection
+	}
+	if config.State != current.State {
+		klog.Warning("state changed, the change will take effect on the next restart")
+		config.State = current.State
+	}
+	if config.ShutdownTimeout != current.ShutdownTimeout {
+		klog.Warning("shutdown_timeout changed, the change will take effect on the next restart")
+		config.ShutdownTimeout = current.ShutdownTimeout
+	}
+	if config.VaultAddress != current.VaultAddress || config.VaultAuth != current.VaultAuth {
+		klog.Info("vault settings changed, authenticating to vault again")
+		a.VaultClient = nil
+	}
+	setRetryPolicy(config.Retry)
+	sched.staggerWindow = config.RefreshStaggerWindow
+	sched.jitter = config.RefreshJitter
+	a.Config = config
+	klog.Info("reloaded the config")
+}
+
+// rescheduleChanged makes targets whose token settings have changed since the last
+// listing due straight away, so that a new vault role, policy or TTL does not wait
+// for the next refresh. It returns the token settings of the current targets, to
+// be passed in with the next listing.
+func (a *App) rescheduleChanged(sched *scheduler, targets map[string]target.Target, previous map[string]string, now time.Time) map[string]string {
+	settings := make(map[string]string, len(targets))
+	for id, t := range targets {
+		settings[id] = a.tokenSettingsHash(a.tokenSettings(t.TokenOptions()))
+		if hash, ok := previous[id]; ok && hash != settings[id] {
+			klog.Infof("token settings of %s target %s changed, refreshing it now", t.Provider(), t.Name())
+			sched.schedule(id, now)
+		}
+	}
+	return settings
+}
+
+// logTargetChanges logs the targets that were added and removed since the last listing
+func logTargetChanges(previous, current map[string]target.Target) {
+	for id, t := range current {
+		if _, ok := previous[id]; !ok {
+			klog.Infof("added %s target %s", t.Provider(), t.Name())
+		}
+	}
+	for id, t := range previous {
+		if _, ok := current[id]; !ok {
+			klog.Infof("removed %s target %s", t.Provider(), t.Name())
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/fairwindsops/vault-token-injector/pkg/gitlab"
+	"github.com/fairwindsops/vault-token-injector/pkg/target"
+	"github.com/fairwindsops/vault-token-injector/pkg/vault"
+)
+
+func TestReload(t *testing.T) {
+	role := "ci"
+	newConfig := func(project string) *Config {
+		return &Config{
+			VaultAddress: "https://vault.example.com",
+			GitLab:       []GitLabConfig{{Project: project, VaultRole: &role}},
+		}
+	}
+	a := &App{
+		Config:       newConfig("group/app"),
+		GitLabClient: &gitlab.Client{Token: "token"},
+		VaultClient:  &vault.Client{},
+	}
+	setDefaults(a.Config)
+	a.Config.LeaderElection = LeaderElectionConfig{Method: leaderElectionFile, LockFile: "/tmp/lock"}
+
+	assert.Nil(t, a.pendingReload())
+
+	invalid := newConfig("group/app")
+	invalid.GitLab[0].VaultRole = nil
+	assert.Error(t, a.Reload(invalid))
+	assert.Nil(t, a.pendingReload(), "an invalid config is not passed on")
+
+	assert.NoError(t, a.Reload(newConfig("group/other")))
+	latest := newConfig("group/latest")
+	latest.VaultAddress = "https://other-vault.example.com"
+	latest.RefreshStaggerWindow = 5 * time.Minute
+	assert.NoError(t, a.Reload(latest))
+	reloaded := a.pendingReload()
+	assert.Equal(t, latest, reloaded, "only the latest config is kept")
+	assert.Nil(t, a.pendingReload())
+
+	sched := newScheduler(time.Minute, 0)
+	a.applyConfig(reloaded, sched)
+	assert.Equal(t, "group/latest", a.Config.GitLab[0].Project)
+	assert.Equal(t, leaderElectionFile, a.Config.LeaderElection.Method, "leader election is kept until restart")
+	assert.Nil(t, a.VaultClient, "vault client is reset when the vault address changes")
+	assert.Equal(t, 5*time.Minute, sched.staggerWindow)
+}
+
+func TestRescheduleChanged(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+	role, other := "ci", "admin"
+	a := &App{Config: &Config{TokenTTL: time.Hour, TokenRefreshInterval: time.Minute * 30}}
+	listing := func(app, static GitLabConfig) map[string]target.Target {
+		targets := map[string]target.Target{}
+		for _, config := range []GitLabConfig{app, static} {
+			t := gitLabTarget{config: config}
+			targets[target.ID(t)] = t
+		}
+		return targets
+	}
+	sched := newScheduler(0, 0)
+	targets := listing(GitLabConfig{Project: "group/app", VaultRole: &role}, GitLabConfig{Project: "group/static", VaultRole: &role})
+	settings := a.rescheduleChanged(sched, targets, nil, now)
+	sched.refreshed("gitlab/group/app", now, time.Minute*30)
+	sched.refreshed("gitlab/group/static", now, time.Minute*30)
+
+	// A changed role, or a changed TTL after a reload, makes the target due straight away
+	later := now.Add(time.Minute)
+	targets = listing(GitLabConfig{Project: "group/app", VaultRole: &other}, GitLabConfig{Project: "group/static", VaultRole: &role})
+	settings = a.rescheduleChanged(sched, targets, settings, later)
+	assert.Equal(t, []string{"gitlab/group/app"}, sched.due(later))
+
+	a.Config.TokenTTL = time.Hour * 2
+	a.rescheduleChanged(sched, targets, settings, later)
+	assert.ElementsMatch(t, []string{"gitlab/group/app", "gitlab/group/static"}, sched.due(later))
+}
@@ -0,0 +1,192 @@
+package app
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/fairwindsops/vault-token-injector/pkg/state"
+	"github.com/fairwindsops/vault-token-injector/pkg/vault"
+)
+
+// revokeRetryInterval is how long to wait before trying a failed revocation again
+const revokeRetryInterval = time.Minute
+
+// injectedToken is the last token injected into a target
+type injectedToken struct {
+	accessor  string
+	expiresAt time.Time
+}
+
+// pendingRevocation is a replaced token of a target that is due to be revoked
+type pendingRevocation struct {
+	id string
+	state.Revocation
+}
+
+// replaceToken records the token that was just injected into a target and returns
+// the revocation of the token that it replaced, or nil if there is nothing to
+// revoke. The revocation is due once the grace period has passed. It is written
+// to the injection history along with the new token, so that it survives a
+// restart, a change of leader or the end of a single run.
+func (a *App) replaceToken(id string, token *vault.Token, now time.Time) *state.Revocation {
+	if !a.Config.RevokePreviousTokens {
+		return nil
+	}
+	current := injectedToken{
+		accessor:  token.Auth.Accessor,
+		expiresAt: now.Add(time.Duration(token.Data.TTL) * time.Second),
+	}
+	a.accessorLock.Lock()
+	if a.injected == nil {
+		a.injected = map[string]injectedToken{}
+	}
+	previous := a.injected[id]
+	a.injected[id] = current
+	a.accessorLock.Unlock()
+
+	if previous.accessor == "" || previous.accessor == current.accessor {
+		return nil
+	}
+	return &state.Revocation{
+		Accessor:  previous.accessor,
+		After:     now.Add(a.Config.RevokeGracePeriod),
+		ExpiresAt: previous.expiresAt,
+	}
+}
+
+// revokeReplaced revokes a replaced token straight away. With a grace period, it
+// is kept as a pending revocation until the grace period has passed instead.
+func (a *App) revokeReplaced(ctx context.Context, pending pendingRevocation, now time.Time) {
+	if a.Config.RevokeGracePeriod > 0 {
+		klog.V(3).Infof("revoking previous token for target %s in %s", pending.id, a.Config.RevokeGracePeriod.String())
+		a.addRevocation(pending)
+		return
+	}
+	a.revokePending(ctx, pending, now)
+}
+
+// revokeUnusedToken revokes a token that was not written to its target, so that it
+// does not stay valid with nobody tracking it
+func (a *App) revokeUnusedToken(ctx context.Context, id string, token *vault.Token) {
+	if !a.Config.RevokePreviousTokens {
+		return
+	}
+	if err := a.VaultClient.RevokeAccessor(ctx, token.Auth.Accessor); err != nil {
+		a.incrementRevokeError()
+		klog.Errorf("error revoking the token that could not be written to target %s: %s", id, err.Error())
+		return
+	}
+	klog.V(3).Infof("revoked the token that could not be written to target %s", id)
+}
+
+// keepUnconfirmedToken keeps a token that may have been written to its target before
+// writing failed as the target's current token. The token it replaced is revoked
+// after the grace period, as if writing had succeeded.
+func (a *App) keepUnconfirmedToken(ctx context.Context, id string, token *vault.Token) {
+	if !a.Config.RevokePreviousTokens {
+		return
+	}
+	now := time.Now()
+	replaced := a.replaceToken(id, token, now)
+	a.recordState(ctx, id, func(record *state.Record) {
+		record.Accessor = token.Auth.Accessor
+		record.ExpiresAt = now.Add(time.Duration(token.Data.TTL) * time.Second)
+		if replaced != nil {
+			record.PendingRevocations = append(record.PendingRevocations, *replaced)
+		}
+	})
+	if replaced != nil {
+		a.revokeReplaced(ctx, pendingRevocation{id: id, Revocation: *replaced}, now)
+	}
+}
+
+// revokeDue revokes every pending revocation whose grace period has passed. A failed
+// revocation is tried again later, until the token it is for has expired.
+func (a *App) revokeDue(ctx context.Context, now time.Time) {
+	a.accessorLock.Lock()
+	var due []pendingRevocation
+	a.revocations = slices.DeleteFunc(a.revocations, func(pending pendingRevocation) bool {
+		if now.Before(pending.After) {
+			return false
+		}
+		due = append(due, pending)
+		return true
+	})
+	a.accessorLock.Unlock()
+
+	for _, pending := range due {
+		a.revokePending(ctx, pending, now)
+	}
+}
+
+// revokePending revokes a pending revocation and removes it from the injection
+// history. If revoking fails, it is kept and tried again later.
+func (a *App) revokePending(ctx context.Context, pending pendingRevocation, now time.Time) {
+	if err := a.revoke(ctx, pending.id, pending.Revocation, now); err != nil && !pending.ExpiresAt.IsZero() {
+		pending.After = now.Add(revokeRetryInterval)
+		a.addRevocation(pending)
+		a.recordState(ctx, pending.id, func(record *state.Record) {
+			for i, revocation := range record.PendingRevocations {
+				if revocation.Accessor == pending.Accessor {
+					record.PendingRevocations[i].After = pending.After
+				}
+			}
+		})
+		return
+	}
+	a.recordState(ctx, pending.id, func(record *state.Record) {
+		record.PendingRevocations = slices.DeleteFunc(record.PendingRevocations, func(revocation state.Revocation) bool {
+			return revocation.Accessor == pending.Accessor
+		})
+	})
+}
+
+// revoke revokes a replaced token, unless it has already expired
+func (a *App) revoke(ctx context.Context, id string, revocation state.Revocation, now time.Time) error {
+	if expired(revocation.ExpiresAt, now) {
+		klog.V(3).Infof("previous token for target %s has already expired", id)
+		return nil
+	}
+	if err := a.VaultClient.RevokeAccessor(ctx, revocation.Accessor); err != nil {
+		a.incrementRevokeError()
+		klog.Errorf("error revoking previous token for target %s: %s", id, err.Error())
+		return err
+	}
+	klog.V(3).Infof("revoked previous token for target %s", id)
+	return nil
+}
+
+// addRevocation adds a pending revocation, replacing any that is already pending for the same token
+func (a *App) addRevocation(pending pendingRevocation) {
+	a.accessorLock.Lock()
+	defer a.accessorLock.Unlock()
+	for i, existing := range a.revocations {
+		if existing.Accessor == pending.Accessor {
+			a.revocations[i] = pending
+			return
+		}
+	}
+	a.revocations = append(a.revocations, pending)
+}
+
+// nextRevocation returns when the next pending revocation is due, or the zero time if there are none
+func (a *App) nextRevocation() time.Time {
+	a.accessorLock.Lock()
+	defer a.accessorLock.Unlock()
+	var next time.Time
+	for _, pending := range a.revocations {
+		if next.IsZero() || pending.After.Before(next) {
+			next = pending.After
+		}
+	}
+	return next
+}
+
+// revocationsDue returns true if any pending revocation is due
+func (a *App) revocationsDue(now time.Time) bool {
+	next := a.nextRevocation()
+	return !next.IsZero() && !now.Before(next)
+}
@@ -0,0 +1,166 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/fairwindsops/vault-token-injector/pkg/state"
+	"github.com/fairwindsops/vault-token-injector/pkg/target"
+)
+
+func newRevokingApp(t *testing.T, v *fakeVault, grace time.Duration, store state.Store) *App {
+	return &App{
+		Config: &Config{
+			VaultAddress:         v.URL,
+			TokenVariable:        "VAULT_TOKEN",
+			TokenTTL:             time.Hour,
+			TokenRefreshInterval: time.Minute * 30,
+			RevokePreviousTokens: true,
+			RevokeGracePeriod:    grace,
+		},
+		VaultClient:   v.client(t),
+		EnableMetrics: true,
+		Metrics: &Metrics{
+			totalErrorCount:  prometheus.NewCounter(prometheus.CounterOpts{Name: "errors"}),
+			vaultErrorCount:  prometheus.NewCounter(prometheus.CounterOpts{Name: "vault_errors"}),
+			revokeErrorCount: prometheus.NewCounter(prometheus.CounterOpts{Name: "revoke_errors"}),
+			targetErrorCount: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "target_errors"}, []string{"provider"}),
+			targetTokensUpdated: prometheus.NewCounterVec(prometheus.CounterOpts{
+				Name: "target_tokens_updated",
+			}, []string{"provider"}),
+		},
+		state: store,
+	}
+}
+
+func inject(a *App, t target.Target) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	a.updateTarget(context.Background(), t, &wg)
+}
+
+func TestRevokePreviousToken(t *testing.T) {
+	v := newFakeVault(t)
+	a := newRevokingApp(t, v, 0, nil)
+	var vars []target.Variable
+	ok := fakeTarget{name: "ok", vars: &vars}
+
+	inject(a, ok)
+	assert.Empty(t, v.revocations(), "the first token has nothing to replace")
+	inject(a, ok)
+	assert.Equal(t, []string{"accessor-1"}, v.revocations())
+
+	// A token that was not written is revoked straight away, and the token in
+	// the target is left alone
+	inject(a, fakeTarget{name: "ok", err: &target.NotWrittenError{Err: errors.New("boom")}, vars: &vars})
+	assert.Equal(t, []string{"accessor-1", "accessor-3"}, v.revocations())
+
+	// A token that was written before the target failed replaces the token in
+	// the target as usual
+	inject(a, fakeTarget{name: "ok", err: errors.New("boom"), partial: true, vars: &vars})
+	assert.Equal(t, []target.Variable{{Key: "VAULT_TOKEN", Value: "token-4", Sensitive: true}}, vars)
+	assert.Equal(t, []string{"accessor-1", "accessor-3", "accessor-2"}, v.revocations())
+	inject(a, ok)
+	assert.Equal(t, []string{"accessor-1", "accessor-3", "accessor-2", "accessor-4"}, v.revocations())
+}
+
+func TestRevokeGracePeriod(t *testing.T) {
+	v := newFakeVault(t)
+	store := &state.FileStore{Path: filepath.Join(t.TempDir(), "state.json")}
+	a := newRevokingApp(t, v, time.Minute*10, store)
+	var vars []target.Variable
+	ok := fakeTarget{name: "ok", vars: &vars}
+
+	inject(a, ok)
+	inject(a, ok)
+	assert.Empty(t, v.revocations(), "the replaced token is kept for the grace period")
+	records, err := store.Load(context.Background())
+	assert.NoError(t, err)
+	pending := records["fake/ok"].PendingRevocations
+	assert.Len(t, pending, 1)
+	assert.Equal(t, "accessor-1", pending[0].Accessor)
+	assert.WithinDuration(t, time.Now().Add(time.Minute*10), pending[0].After, time.Minute)
+
+	// A restarted injector, or the next single run, picks up the pending revocation
+	restarted := newRevokingApp(t, v, time.Minute*10, store)
+	restarted.loadState(context.Background())
+	restarted.revokeDue(context.Background(), time.Now())
+	assert.Empty(t, v.revocations(), "the grace period has not passed yet")
+	restarted.revokeDue(context.Background(), time.Now().Add(time.Minute*20))
+	assert.Equal(t, []string{"accessor-1"}, v.revocations())
+	assert.True(t, restarted.nextRevocation().IsZero())
+	records, err = store.Load(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, records["fake/ok"].PendingRevocations)
+
+	// The token that replaced it is revoked by the restarted injector in turn
+	inject(restarted, ok)
+	restarted.revokeDue(context.Background(), time.Now().Add(time.Minute*20))
+	assert.Equal(t, []string{"accessor-1", "accessor-2"}, v.revocations())
+}
+
+func TestRevokeFailure(t *testing.T) {
+	v := newFakeVault(t)
+	v.revokeStatus = http.StatusBadRequest
+	store := &state.FileStore{Path: filepath.Join(t.TempDir(), "state.json")}
+	a := newRevokingApp(t, v, 0, store)
+	var vars []target.Variable
+	ok := fakeTarget{name: "ok", vars: &vars}
+
+	inject(a, ok)
+	inject(a, ok)
+	assert.Equal(t, float64(1), getMetricValue(a.Metrics.revokeErrorCount))
+	assert.Equal(t, float64(0), getMetricValue(a.Metrics.vaultErrorCount), "failed revocations do not fail the health check")
+
+	// The failed revocation is tried again later
+	now := time.Now()
+	assert.WithinDuration(t, now.Add(revokeRetryInterval), a.nextRevocation(), time.Minute)
+	v.revokeStatus = 0
+	a.revokeDue(context.Background(), now.Add(revokeRetryInterval*2))
+	assert.Equal(t, []string{"accessor-1"}, v.revocations())
+	assert.True(t, a.nextRevocation().IsZero())
+
+	// Once the token has expired there is nothing left to revoke
+	v.revokeStatus = http.StatusBadRequest
+	inject(a, ok)
+	a.revokeDue(context.Background(), now.Add(time.Hour*2))
+	assert.True(t, a.nextRevocation().IsZero())
+	records, err := store.Load(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, records["fake/ok"].PendingRevocations)
+}
+
+func TestRevokeAfterOutage(t *testing.T) {
+	v := newFakeVault(t)
+	store := &state.FileStore{Path: filepath.Join(t.TempDir(), "state.json")}
+	long := time.Now().Add(-time.Hour * 24)
+	assert.NoError(t, store.Update(context.Background(), "fake/ok", func(record *state.Record) {
+		record.LastSuccess = long
+		record.Accessor = "expired-accessor"
+		record.ExpiresAt = long.Add(time.Hour)
+		record.PendingRevocations = []state.Revocation{
+			{Accessor: "expired-pending", After: long.Add(time.Minute), ExpiresAt: long.Add(time.Hour)},
+			{Accessor: "valid-pending", After: long.Add(time.Minute), ExpiresAt: time.Now().Add(time.Hour)},
+		}
+	}))
+
+	// Tokens that expired while the injector was down are not revoked
+	a := newRevokingApp(t, v, 0, store)
+	a.loadState(context.Background())
+	var vars []target.Variable
+	inject(a, fakeTarget{name: "ok", vars: &vars})
+	a.revokeDue(context.Background(), time.Now())
+	assert.Equal(t, []string{"valid-pending"}, v.revocations())
+	assert.Equal(t, float64(0), getMetricValue(a.Metrics.revokeErrorCount))
+	records, err := store.Load(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, records["fake/ok"].PendingRevocations)
+}
@@ -0,0 +1,98 @@
+package app
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// scheduler tracks when each target is next due for a refresh. New targets are
+// spread evenly across the stagger window so that they are not all refreshed at
+// once, and every refresh after that is brought forward by a random jitter so
+// that targets drift apart over time instead of bunching up.
+type scheduler struct {
+	// staggerWindow is the window that the first refresh of new targets is spread across
+	staggerWindow time.Duration
+	// jitter is the largest fraction of the refresh interval a refresh can be brought forward by
+	jitter float64
+	// random returns a number in [0, 1). It is replaced in tests
+	random func() float64
+
+	nextRun map[string]time.Time
+}
+
+func newScheduler(staggerWindow time.Duration, jitter float64) *scheduler {
+	return &scheduler{
+		staggerWindow: staggerWindow,
+		jitter:        jitter,
+		random:        rand.Float64,
+		nextRun:       map[string]time.Time{},
+	}
+}
+
+// update sets the targets being scheduled, along with the refresh interval of
+// each. Targets that are not already scheduled are staggered across the window
+// starting at now, or across their refresh interval if that is shorter, and
+// targets that are no longer present are forgotten.
+func (s *scheduler) update(intervals map[string]time.Duration, now time.Time) {
+	var added []string
+	for id := range intervals {
+		if _, ok := s.nextRun[id]; !ok {
+			added = append(added, id)
+		}
+	}
+	for id := range s.nextRun {
+		if _, ok := intervals[id]; !ok {
+			delete(s.nextRun, id)
+		}
+	}
+	sort.Strings(added)
+	for i, id := range added {
+		window := s.staggerWindow
+		if interval := intervals[id]; interval > 0 && interval < window {
+			window = interval
+		}
+		offset := time.Duration(0)
+		if len(added) > 1 {
+			offset = window * time.Duration(i) / time.Duration(len(added))
+		}
+		s.nextRun[id] = now.Add(offset)
+	}
+}
+
+// schedule sets when a target is next due. A target scheduled before update is
+// called is treated as already known, so it is not staggered.
+func (s *scheduler) schedule(id string, at time.Time) {
+	s.nextRun[id] = at
+}
+
+// due returns the targets that are due for a refresh at the given time, earliest first
+func (s *scheduler) due(now time.Time) []string {
+	var ids []string
+	for id, next := range s.nextRun {
+		if !now.Before(next) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return s.nextRun[ids[i]].Before(s.nextRun[ids[j]])
+	})
+	return ids
+}
+
+// refreshed schedules the next refresh of a target one interval after now, less the jitter
+func (s *scheduler) refreshed(id string, now time.Time, interval time.Duration) {
+	jitter := time.Duration(float64(interval) * s.jitter * s.random())
+	s.nextRun[id] = now.Add(interval - jitter)
+}
+
+// next returns the time the next target is due, or the zero time if there are no targets
+func (s *scheduler) next() time.Time {
+	var next time.Time
+	for _, t := range s.nextRun {
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	return next
+}
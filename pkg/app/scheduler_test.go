@@ -0,0 +1,54 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduler(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := newScheduler(time.Minute, 0.5)
+	s.random = func() float64 { return 0.5 }
+
+	// New targets are spread across the stagger window
+	s.update(map[string]time.Duration{"c": time.Hour, "a": time.Hour, "b": time.Hour}, now)
+	assert.EqualValues(t, map[string]time.Time{
+		"a": now,
+		"b": now.Add(time.Second * 20),
+		"c": now.Add(time.Second * 40),
+	}, s.nextRun)
+	assert.Equal(t, []string{"a"}, s.due(now))
+	assert.Equal(t, []string{"a", "b", "c"}, s.due(now.Add(time.Minute)))
+
+	// Refreshes are brought forward by the jitter
+	s.refreshed("a", now, time.Minute*30)
+	assert.Equal(t, now.Add(time.Minute*30-time.Minute*30/4), s.nextRun["a"])
+	assert.Equal(t, now.Add(time.Second*20), s.next())
+
+	// Removed targets are forgotten and existing targets keep their schedule
+	s.update(map[string]time.Duration{"a": time.Hour, "d": time.Hour}, now.Add(time.Minute))
+	assert.EqualValues(t, map[string]time.Time{
+		"a": now.Add(time.Minute*30 - time.Minute*30/4),
+		"d": now.Add(time.Minute),
+	}, s.nextRun)
+
+	// Targets with a refresh interval shorter than the window are staggered across their interval
+	s = newScheduler(time.Hour, 0)
+	s.update(map[string]time.Duration{"a": time.Hour, "b": time.Hour, "c": time.Minute * 30, "d": time.Minute * 15}, now)
+	assert.EqualValues(t, map[string]time.Time{
+		"a": now,
+		"b": now.Add(time.Minute * 15),
+		"c": now.Add(time.Minute * 15),
+		"d": now.Add(time.Minute * 15 * 3 / 4),
+	}, s.nextRun)
+}
+
+func TestVaultBackoff(t *testing.T) {
+	assert.Equal(t, time.Second*10, vaultBackoff(1))
+	assert.Equal(t, time.Second*20, vaultBackoff(2))
+	assert.Equal(t, time.Second*160, vaultBackoff(5))
+	assert.Equal(t, time.Minute*5, vaultBackoff(6))
+	assert.Equal(t, time.Minute*5, vaultBackoff(100))
+}
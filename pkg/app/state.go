@@ -0,0 +1,206 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/fairwindsops/vault-token-injector/pkg/state"
+	"github.com/fairwindsops/vault-token-injector/pkg/target"
+	"github.com/fairwindsops/vault-token-injector/pkg/vault"
+)
+
+const (
+	stateBackendFile      = "file"
+	stateBackendConfigMap = state.KindConfigMap
+	stateBackendSecret    = state.KindSecret
+)
+
+// newStateStore returns the configured state store, or nil if history is not kept
+func newStateStore(config StateConfig) (state.Store, error) {
+	switch config.Backend {
+	case "":
+		return nil, nil
+	case stateBackendFile:
+		if config.Path == "" {
+			return nil, fmt.Errorf("the file state backend requires a path")
+		}
+		return &state.FileStore{Path: config.Path}, nil
+	case stateBackendConfigMap, stateBackendSecret:
+		return &state.KubernetesStore{
+			Kind:      config.Backend,
+			Name:      config.Name,
+			Namespace: config.Namespace,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown state backend %s", config.Backend)
+	}
+}
+
+// LoadState returns the injection history of every target, by target ID, from
+// the state store in the config
+func LoadState(ctx context.Context, config *Config) (map[string]state.Record, error) {
+	store, err := newStateStore(config.State)
+	if err != nil {
+		return nil, err
+	}
+	if store == nil {
+		return nil, fmt.Errorf("no state backend is configured")
+	}
+	return store.Load(ctx)
+}
+
+func (a *App) openState() error {
+	store, err := newStateStore(a.Config.State)
+	if err != nil {
+		return err
+	}
+	a.state = store
+	return nil
+}
+
+// loadState reads the injection history and picks up the tokens injected before a
+// restart, so that they can still be revoked when replaced, along with any
+// revocations that were still waiting out their grace period. Tokens that have
+// expired since are skipped, as there is nothing left to revoke, and expired
+// revocations are dropped from the history.
+func (a *App) loadState(ctx context.Context) map[string]state.Record {
+	if a.state == nil {
+		return nil
+	}
+	records, err := a.state.Load(ctx)
+	if err != nil {
+		klog.Errorf("could not load the injection history, continuing without it: %s", err.Error())
+		return nil
+	}
+	klog.V(3).Infof("loaded the injection history of %d targets", len(records))
+	now := time.Now()
+	a.accessorLock.Lock()
+	if a.injected == nil {
+		a.injected = map[string]injectedToken{}
+	}
+	for id, record := range records {
+		if _, ok := a.injected[id]; !ok && record.Accessor != "" && !expired(record.ExpiresAt, now) {
+			a.injected[id] = injectedToken{accessor: record.Accessor, expiresAt: record.ExpiresAt}
+		}
+	}
+	a.accessorLock.Unlock()
+	for id, record := range records {
+		dropped := false
+		for _, revocation := range record.PendingRevocations {
+			if expired(revocation.ExpiresAt, now) {
+				dropped = true
+				continue
+			}
+			a.addRevocation(pendingRevocation{id: id, Revocation: revocation})
+		}
+		if dropped {
+			a.recordState(ctx, id, func(record *state.Record) {
+				record.PendingRevocations = slices.DeleteFunc(record.PendingRevocations, func(revocation state.Revocation) bool {
+					return expired(revocation.ExpiresAt, now)
+				})
+			})
+		}
+	}
+	return records
+}
+
+// expired returns true if a token that expires at the given time has expired. A
+// zero time means the expiry is not known, so the token is treated as still valid.
+func expired(expiresAt time.Time, now time.Time) bool {
+	return !expiresAt.IsZero() && !now.Before(expiresAt)
+}
+
+// maxExpiryMargin caps how long before it expires a recorded token is replaced
+const maxExpiryMargin = time.Minute * 5
+
+// freshUntil returns when the token recorded for a target should be replaced. It is
+// the zero time if there is no usable record, if the last injection failed, as
+// the target may have been left with a token that was never recorded, or if the
+// token settings of the target have changed since. A token is replaced a little
+// before it expires, so that the target is not left with an expired token while
+// the new one is written.
+func (a *App) freshUntil(record state.Record, t target.Target) time.Time {
+	if record.LastSuccess.IsZero() || record.LastErrorTime.After(record.LastSuccess) {
+		return time.Time{}
+	}
+	opts := a.tokenSettings(t.TokenOptions())
+	// Records from before the settings were kept are assumed to match
+	if record.TokenSettings != "" && record.TokenSettings != a.tokenSettingsHash(opts) {
+		klog.V(3).Infof("token settings of %s target %s have changed since it was injected", t.Provider(), t.Name())
+		return time.Time{}
+	}
+	maxAge := opts.RefreshInterval
+	if a.Config.RotationThreshold > 0 {
+		maxAge = time.Duration(float64(opts.TTL) * a.Config.RotationThreshold)
+	}
+	freshUntil := record.LastSuccess.Add(maxAge)
+	if !record.ExpiresAt.IsZero() {
+		margin := min(record.ExpiresAt.Sub(record.LastSuccess)/10, maxExpiryMargin)
+		if expiry := record.ExpiresAt.Add(-margin); expiry.Before(freshUntil) {
+			freshUntil = expiry
+		}
+	}
+	return freshUntil
+}
+
+// tokenSettingsHash returns a hash of the resolved settings that a token is created
+// and written with, so that a recorded token can be replaced once they change. The
+// refresh interval is left out, as it does not change the token.
+func (a *App) tokenSettingsHash(opts target.TokenOptions) string {
+	role := ""
+	if opts.VaultRole != nil {
+		role = *opts.VaultRole
+	}
+	orphan := opts.Orphan != nil && *opts.Orphan
+	policies := slices.Sorted(slices.Values(opts.VaultPolicies))
+	sum := sha256.Sum256(fmt.Appendf(nil, "%q %q %s %t %q %q", role, policies, opts.TTL.String(), orphan, opts.TokenVariable, a.Config.VaultAddress))
+	return hex.EncodeToString(sum[:])
+}
+
+// recordSuccess records the token written to a target, along with the revocation
+// of the token it replaced if there is one, in a single update
+func (a *App) recordSuccess(ctx context.Context, t target.Target, token *vault.Token, replaced *state.Revocation) {
+	now := time.Now()
+	if reporter, ok := t.(statusReporter); ok {
+		reporter.reportSuccess(ctx, now, token)
+	}
+	settings := a.tokenSettingsHash(a.tokenSettings(t.TokenOptions()))
+	a.recordState(ctx, target.ID(t), func(record *state.Record) {
+		record.LastSuccess = now
+		record.LastError = ""
+		record.Accessor = token.Auth.Accessor
+		record.ExpiresAt = now.Add(time.Duration(token.Data.TTL) * time.Second)
+		record.TokenSettings = settings
+		if replaced != nil {
+			record.PendingRevocations = append(record.PendingRevocations, *replaced)
+		}
+	})
+}
+
+func (a *App) recordError(ctx context.Context, t target.Target, err error) {
+	now := time.Now()
+	if reporter, ok := t.(statusReporter); ok {
+		reporter.reportError(ctx, now, err)
+	}
+	a.recordState(ctx, target.ID(t), func(record *state.Record) {
+		record.LastError = err.Error()
+		record.LastErrorTime = now
+	})
+}
+
+// recordState updates the history of a target. Failing to record it is logged
+// but does not fail the injection.
+func (a *App) recordState(ctx context.Context, id string, fn func(*state.Record)) {
+	if a.state == nil {
+		return
+	}
+	if err := a.state.Update(ctx, id, fn); err != nil {
+		klog.Errorf("could not record the injection history of target %s: %s", id, err.Error())
+	}
+}
@@ -0,0 +1,654 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"k8s.io/klog/v2"
+
+	"github.com/fairwindsops/vault-token-injector/pkg/circleci"
+	"github.com/fairwindsops/vault-token-injector/pkg/crd"
+	"github.com/fairwindsops/vault-token-injector/pkg/github"
+	"github.com/fairwindsops/vault-token-injector/pkg/gitlab"
+	"github.com/fairwindsops/vault-token-injector/pkg/spacelift"
+	"github.com/fairwindsops/vault-token-injector/pkg/target"
+	"github.com/fairwindsops/vault-token-injector/pkg/tfcloud"
+)
+
+const (
+	providerCircleCI  = "circleci"
+	providerTFCloud   = "tfcloud"
+	providerSpacelift = "spacelift"
+	providerGitHub    = "github"
+	providerGitLab    = "gitlab"
+)
+
+// staticProvider is a provider with a fixed list of targets built from the config file
+type staticProvider struct {
+	name    string
+	targets []target.Target
+}
+
+func (p staticProvider) Name() string {
+	return p.name
+}
+
+func (p staticProvider) Targets(ctx context.Context) ([]target.Target, error) {
+	return p.targets, nil
+}
+
+// providers returns the built-in providers from the config file, the provider of
+// VaultTokenInjection resources when the controller is enabled, and then any
+// providers that have been registered with the target package. A registered
+// provider with the same name as a built-in one is used in its place. With
+// dryRun set, invalid resources are returned as errors instead of having the
+// problem written to their status.
+func (a *App) providers(dryRun bool) []target.Provider {
+	circleTargets := make([]target.Target, 0, len(a.Config.CircleCI))
+	for _, project := range a.Config.CircleCI {
+		circleTargets = append(circleTargets, a.newCircleCITarget(project))
+	}
+	tfCloudTargets := make([]target.Target, 0, len(a.Config.TFCloud))
+	for _, workspace := range a.Config.TFCloud {
+		tfCloudTargets = append(tfCloudTargets, a.newTFCloudTarget(workspace))
+	}
+	spaceliftTargets := make([]target.Target, 0, len(a.Config.Spacelift))
+	for _, stack := range a.Config.Spacelift {
+		spaceliftTargets = append(spaceliftTargets, spaceliftTarget{config: stack, client: a.SpaceliftClient})
+	}
+	githubTargets := make([]target.Target, 0, len(a.Config.GitHub))
+	for _, repo := range a.Config.GitHub {
+		githubTargets = append(githubTargets, gitHubTarget{config: repo, client: a.GitHubClient})
+	}
+	gitlabTargets := make([]target.Target, 0, len(a.Config.GitLab))
+	for _, project := range a.Config.GitLab {
+		gitlabTargets = append(gitlabTargets, gitLabTarget{config: project, client: a.GitLabClient})
+	}
+
+	providers := []target.Provider{
+		staticProvider{name: providerCircleCI, targets: circleTargets},
+		staticProvider{name: providerTFCloud, targets: tfCloudTargets},
+		tfCloudDiscoveryProvider{app: a, selectors: a.Config.TFCloudDiscovery},
+		staticProvider{name: providerSpacelift, targets: spaceliftTargets},
+		spaceliftDiscoveryProvider{client: a.SpaceliftClient, selectors: a.Config.SpaceliftDiscovery, configured: a.Config.Spacelift},
+		staticProvider{name: providerGitHub, targets: githubTargets},
+		staticProvider{name: providerGitLab, targets: gitlabTargets},
+	}
+	providers = withRegistered(providers, target.Registered())
+	if a.Config.Controller.Enabled {
+		if a.injections == nil {
+			a.injections = &crd.Client{}
+		}
+		a.injections.LabelSelector = a.Config.Controller.LabelSelector
+		// The controller is listed last, once every other provider has reserved its targets
+		reserved := map[string]string{}
+		for i, provider := range providers {
+			providers[i] = reservingProvider{Provider: provider, reserved: reserved}
+		}
+		providers = append(providers, controllerProvider{app: a, client: a.injections, reserved: reserved, dryRun: dryRun})
+	}
+	return providers
+}
+
+// withRegistered appends the registered providers to the built-in ones, dropping
+// any built-in provider that has the same name as a registered one
+func withRegistered(builtIn, registered []target.Provider) []target.Provider {
+	builtIn = slices.DeleteFunc(builtIn, func(p target.Provider) bool {
+		return slices.ContainsFunc(registered, func(r target.Provider) bool {
+			return r.Name() == p.Name()
+		})
+	})
+	return append(builtIn, registered...)
+}
+
+// destination identifies what a target writes to, so that a target declared twice
+// can be found. It is the target ID, except for TFCloud, where the ID comes from
+// an optional name that two targets for the same workspace or variable set can
+// set differently.
+func destination(t target.Target) string {
+	if injection, ok := t.(injectionTarget); ok {
+		t = injection.Target
+	}
+	tfCloud, ok := t.(tfCloudTarget)
+	if !ok {
+		return target.ID(t)
+	}
+	if tfCloud.config.VariableSet != "" {
+		return fmt.Sprintf("%s/varset:%s/%s", providerTFCloud, tfCloud.config.Organization, tfCloud.config.VariableSet)
+	}
+	return fmt.Sprintf("%s/%s", providerTFCloud, tfCloud.config.Workspace)
+}
+
+// circleCITarget is a CircleCI project or context
+type circleCITarget struct {
+	config  CircleCIConfig
+	client  circleci.Client
+	vcsType string
+}
+
+// newCircleCITarget resolves the CircleCI URL and VCS type for a project, falling back
+// to the global settings and then the CircleCI cloud defaults
+func (a *App) newCircleCITarget(project CircleCIConfig) circleCITarget {
+	t := circleCITarget{
+		config:  project,
+		client:  circleci.Client{Token: a.CircleToken, URL: project.URL},
+		vcsType: project.VCSType,
+	}
+	if t.client.URL == "" {
+		t.client.URL = a.Config.CircleCIURL
+	}
+	if t.vcsType == "" {
+		t.vcsType = a.Config.CircleCIVCSType
+	}
+	if t.vcsType == "" {
+		t.vcsType = circleci.DefaultVCSType
+	}
+	return t
+}
+
+func (t circleCITarget) Provider() string {
+	return providerCircleCI
+}
+
+func (t circleCITarget) Name() string {
+	if t.config.Context != "" {
+		return fmt.Sprintf("context:%s/%s", t.config.Organization, t.config.Context)
+	}
+	return t.config.Name
+}
+
+func (t circleCITarget) Validate() error {
+	if t.config.Name == "" && t.config.Context == "" {
+		return fmt.Errorf("CircleCI project name or context is required")
+	}
+	if t.config.Name != "" && t.config.Context != "" {
+		return fmt.Errorf("only one of CircleCI project name or context can be set")
+	}
+	if t.config.Context != "" && t.config.Organization == "" {
+		return fmt.Errorf("CircleCI context requires an organization")
+	}
+	if t.client.Token == "" {
+		return fmt.Errorf("CircleCI is configured but no token was provided")
+	}
+	return nil
+}
+
+func (t circleCITarget) TokenOptions() target.TokenOptions {
+	return t.config.tokenOptions(t.config.VaultRole, t.config.VaultPolicies)
+}
+
+func (t circleCITarget) SetVariables(ctx context.Context, vars []target.Variable) error {
+	if t.config.Context != "" {
+		contextID, err := t.client.GetContextID(ctx, t.vcsType, t.config.Organization, t.config.Context)
+		if err != nil {
+			return &target.NotWrittenError{Err: err}
+		}
+		for _, v := range vars {
+			if err := t.client.UpdateContextEnvVar(ctx, contextID, v.Key, v.Value); err != nil {
+				return fmt.Errorf("error setting %s: %w", v.Key, err)
+			}
+		}
+		return nil
+	}
+	projectSlug := fmt.Sprintf("%s/%s", t.vcsType, t.config.Name)
+	for _, v := range vars {
+		if err := t.client.UpdateEnvVar(ctx, projectSlug, v.Key, v.Value); err != nil {
+			return fmt.Errorf("error setting %s: %w", v.Key, err)
+		}
+	}
+	return nil
+}
+
+func (t circleCITarget) Check(ctx context.Context) error {
+	if t.config.Context != "" {
+		return t.client.CheckContext(ctx, t.vcsType, t.config.Organization, t.config.Context)
+	}
+	return t.client.CheckProject(ctx, fmt.Sprintf("%s/%s", t.vcsType, t.config.Name))
+}
+
+// tfCloudTarget is a TFCloud workspace or variable set
+type tfCloudTarget struct {
+	config TFCloudConfig
+	token  string
+}
+
+// newTFCloudTarget resolves the TFCloud address and CA bundle for a workspace,
+// falling back to the global settings
+func (a *App) newTFCloudTarget(workspace TFCloudConfig) tfCloudTarget {
+	if workspace.Address == "" {
+		workspace.Address = a.Config.TFCloudAddress
+	}
+	if workspace.CABundle == "" {
+		workspace.CABundle = a.Config.TFCloudCABundle
+	}
+	return tfCloudTarget{config: workspace, token: a.TFCloudToken}
+}
+
+func (t tfCloudTarget) Provider() string {
+	return providerTFCloud
+}
+
+// Name returns the optional name of the workspace, falling back to the workspace ID
+func (t tfCloudTarget) Name() string {
+	if t.config.Name != "" {
+		return t.config.Name
+	}
+	if t.config.VariableSet != "" {
+		return fmt.Sprintf("varset:%s/%s", t.config.Organization, t.config.VariableSet)
+	}
+	return t.config.Workspace
+}
+
+func (t tfCloudTarget) Validate() error {
+	if t.config.Workspace == "" && t.config.VariableSet == "" {
+		return fmt.Errorf("TFCloud workspace ID or variable set is required")
+	}
+	if t.config.Workspace != "" && t.config.VariableSet != "" {
+		return fmt.Errorf("only one of TFCloud workspace ID or variable set can be set")
+	}
+	if t.config.VariableSet != "" && t.config.Organization == "" {
+		return fmt.Errorf("TFCloud variable set requires an organization")
+	}
+	if t.token == "" {
+		return fmt.Errorf("TFCloud is configured but no token was provided")
+	}
+	return nil
+}
+
+func (t tfCloudTarget) TokenOptions() target.TokenOptions {
+	return t.config.tokenOptions(t.config.VaultRole, t.config.VaultPolicies)
+}
+
+func (t tfCloudTarget) SetVariables(ctx context.Context, vars []target.Variable) error {
+	if t.config.VariableSet != "" {
+		varsetVars := make([]tfcloud.VariableSetVariable, 0, len(vars))
+		for _, v := range vars {
+			varsetVars = append(varsetVars, tfcloud.VariableSetVariable{
+				Key:       v.Key,
+				Value:     v.Value,
+				Sensitive: v.Sensitive,
+			})
+		}
+		varset := tfcloud.VariableSet{
+			Organization:  t.config.Organization,
+			Name:          t.config.VariableSet,
+			Token:         t.token,
+			Address:       t.config.Address,
+			CABundle:      t.config.CABundle,
+			WorkspaceTags: t.config.WorkspaceTags,
+			ProjectTags:   t.config.ProjectTags,
+		}
+		return varset.Update(ctx, varsetVars)
+	}
+	for _, v := range vars {
+		variable := tfcloud.Variable{
+			Key:                 v.Key,
+			Value:               v.Value,
+			Sensitive:           v.Sensitive,
+			Token:               t.token,
+			Address:             t.config.Address,
+			CABundle:            t.config.CABundle,
+			Workspace:           t.config.Workspace,
+			WorkspaceIdentifier: t.Name(),
+		}
+		if err := variable.Update(ctx); err != nil {
+			return fmt.Errorf("error setting %s: %w", v.Key, err)
+		}
+	}
+	return nil
+}
+
+func (t tfCloudTarget) Check(ctx context.Context) error {
+	if t.config.VariableSet != "" {
+		return tfcloud.VariableSet{
+			Organization: t.config.Organization,
+			Name:         t.config.VariableSet,
+			Token:        t.token,
+			Address:      t.config.Address,
+			CABundle:     t.config.CABundle,
+		}.Check(ctx)
+	}
+	return tfcloud.Variable{
+		Token:               t.token,
+		Address:             t.config.Address,
+		CABundle:            t.config.CABundle,
+		Workspace:           t.config.Workspace,
+		WorkspaceIdentifier: t.Name(),
+	}.Check(ctx)
+}
+
+// tfCloudDiscoveryProvider finds TFCloud workspaces matching the discovery selectors
+type tfCloudDiscoveryProvider struct {
+	app       *App
+	selectors []TFCloudDiscoveryConfig
+}
+
+func (p tfCloudDiscoveryProvider) Name() string {
+	return providerTFCloud
+}
+
+// Targets lists the workspaces matching each selector. A selector that fails is
+// skipped so that it does not prevent injecting into the others. Discovered
+// workspaces are named by organization and workspace ID, as workspace names are
+// only unique within an organization. Workspaces that are also listed in the
+// config file, or that an earlier selector matched, are skipped.
+func (p tfCloudDiscoveryProvider) Targets(ctx context.Context) ([]target.Target, error) {
+	var targets []target.Target
+	var errs []error
+	skip := map[string]bool{}
+	for _, workspace := range p.app.Config.TFCloud {
+		if workspace.Workspace != "" {
+			skip[workspace.Workspace] = true
+		}
+	}
+	for _, selector := range p.selectors {
+		workspaceConfig := TFCloudConfig{
+			Address:        selector.Address,
+			CABundle:       selector.CABundle,
+			VaultRole:      selector.VaultRole,
+			VaultPolicies:  selector.VaultPolicies,
+			TokenOverrides: selector.TokenOverrides,
+		}
+		base := p.app.newTFCloudTarget(workspaceConfig)
+		workspaces, err := tfcloud.WorkspaceSelector{
+			Organization: selector.Organization,
+			Token:        base.token,
+			Address:      base.config.Address,
+			CABundle:     base.config.CABundle,
+			Tags:         selector.Tags,
+			Project:      selector.Project,
+			NameRegex:    selector.NameRegex,
+		}.List(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error discovering workspaces in organization %s: %w", selector.Organization, err))
+			continue
+		}
+		for _, ws := range workspaces {
+			if skip[ws.ID] {
+				klog.V(3).Infof("skipping discovered TFCloud workspace %s (%s), it is already configured", ws.Name, ws.ID)
+				continue
+			}
+			skip[ws.ID] = true
+			klog.V(3).Infof("discovered TFCloud workspace %s (%s) in organization %s", ws.Name, ws.ID, selector.Organization)
+			t := base
+			t.config.Workspace = ws.ID
+			t.config.Name = fmt.Sprintf("%s/%s", selector.Organization, ws.ID)
+			targets = append(targets, t)
+		}
+	}
+	return targets, errors.Join(errs...)
+}
+
+// spaceliftTarget is a Spacelift stack or context
+type spaceliftTarget struct {
+	config SpaceliftConfig
+	client *spacelift.Client
+}
+
+func (t spaceliftTarget) Provider() string {
+	return providerSpacelift
+}
+
+func (t spaceliftTarget) Name() string {
+	if t.config.Context != "" {
+		return fmt.Sprintf("context:%s", t.config.Context)
+	}
+	return t.config.Stack
+}
+
+func (t spaceliftTarget) Validate() error {
+	if t.config.Stack == "" && t.config.Context == "" {
+		return fmt.Errorf("Spacelift stack or context is required")
+	}
+	if t.config.Stack != "" && t.config.Context != "" {
+		return fmt.Errorf("only one of Spacelift stack or context can be set")
+	}
+	if t.client == nil {
+		return fmt.Errorf("Spacelift is configured but no client was provided")
+	}
+	return nil
+}
+
+func (t spaceliftTarget) TokenOptions() target.TokenOptions {
+	return t.config.tokenOptions(t.config.VaultRole, t.config.VaultPolicies)
+}
+
+func (t spaceliftTarget) SetVariables(ctx context.Context, vars []target.Variable) error {
+	if err := t.client.RefreshJWT(ctx); err != nil {
+		return &target.NotWrittenError{Err: fmt.Errorf("could not refresh Spacelift API auth via JWT: %w", err)}
+	}
+	envVars := make([]spacelift.EnvVar, 0, len(vars))
+	for _, v := range vars {
+		envVars = append(envVars, spacelift.EnvVar{
+			Key:       v.Key,
+			Value:     v.Value,
+			WriteOnly: v.Sensitive,
+		})
+	}
+	if t.config.Context != "" {
+		return t.client.SetContextEnvVars(ctx, t.config.Context, envVars)
+	}
+	return t.client.SetEnvVars(ctx, t.config.Stack, envVars)
+}
+
+func (t spaceliftTarget) Check(ctx context.Context) error {
+	if err := t.client.RefreshJWT(ctx); err != nil {
+		return fmt.Errorf("could not refresh Spacelift API auth via JWT: %w", err)
+	}
+	if t.config.Context != "" {
+		return t.client.CheckContext(ctx, t.config.Context)
+	}
+	return t.client.CheckStack(ctx, t.config.Stack)
+}
+
+// spaceliftDiscoveryProvider finds Spacelift stacks matching the discovery selectors
+type spaceliftDiscoveryProvider struct {
+	client    *spacelift.Client
+	selectors []SpaceliftDiscoveryConfig
+	// configured are the stacks and contexts listed in the config file
+	configured []SpaceliftConfig
+}
+
+func (p spaceliftDiscoveryProvider) Name() string {
+	return providerSpacelift
+}
+
+// Targets lists the stacks matching each selector. A selector that fails is
+// skipped so that it does not prevent injecting into the others. Stacks that are
+// also listed in the config file, or that an earlier selector matched, are skipped.
+func (p spaceliftDiscoveryProvider) Targets(ctx context.Context) ([]target.Target, error) {
+	if len(p.selectors) == 0 {
+		return nil, nil
+	}
+	if p.client == nil {
+		return nil, fmt.Errorf("Spacelift discovery is configured but no client was provided")
+	}
+	if err := p.client.RefreshJWT(ctx); err != nil {
+		return nil, fmt.Errorf("could not refresh Spacelift API auth via JWT: %w", err)
+	}
+	var targets []target.Target
+	var errs []error
+	skip := map[string]bool{}
+	for _, stack := range p.configured {
+		if stack.Stack != "" {
+			skip[stack.Stack] = true
+		}
+	}
+	for _, selector := range p.selectors {
+		if len(selector.Labels) == 0 && len(selector.Spaces) == 0 {
+			errs = append(errs, fmt.Errorf("Spacelift discovery selector has no labels or spaces"))
+			continue
+		}
+		stacks, err := p.client.FindStacks(ctx, selector.Labels, selector.Spaces)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error discovering stacks with labels %v in spaces %v: %w", selector.Labels, selector.Spaces, err))
+			continue
+		}
+		for _, stack := range stacks {
+			if skip[stack.ID] {
+				klog.V(3).Infof("skipping discovered Spacelift stack %s, it is already configured", stack.ID)
+				continue
+			}
+			skip[stack.ID] = true
+			klog.V(3).Infof("discovered Spacelift stack %s", stack.ID)
+			targets = append(targets, spaceliftTarget{
+				config: SpaceliftConfig{
+					Stack:          stack.ID,
+					VaultRole:      selector.VaultRole,
+					VaultPolicies:  selector.VaultPolicies,
+					TokenOverrides: selector.TokenOverrides,
+				},
+				client: p.client,
+			})
+		}
+	}
+	return targets, errors.Join(errs...)
+}
+
+// gitHubTarget is a GitHub repository, repository environment, or organization
+type gitHubTarget struct {
+	config GitHubConfig
+	client *github.Client
+}
+
+func (t gitHubTarget) Provider() string {
+	return providerGitHub
+}
+
+func (t gitHubTarget) Name() string {
+	if t.config.Organization != "" {
+		return t.config.Organization
+	}
+	if t.config.Environment != "" {
+		return fmt.Sprintf("%s/%s", t.config.Repository, t.config.Environment)
+	}
+	return t.config.Repository
+}
+
+func (t gitHubTarget) Validate() error {
+	if t.config.Repository == "" && t.config.Organization == "" {
+		return fmt.Errorf("GitHub repository or organization is required")
+	}
+	if t.config.Repository != "" && t.config.Organization != "" {
+		return fmt.Errorf("only one of GitHub repository or organization can be set")
+	}
+	if t.config.Environment != "" && t.config.Repository == "" {
+		return fmt.Errorf("GitHub environment requires a repository")
+	}
+	switch t.config.Visibility {
+	case "", "all", "private":
+		if len(t.config.SelectedRepositoryIDs) > 0 {
+			return fmt.Errorf("GitHub selected_repository_ids requires selected visibility")
+		}
+	case "selected":
+		if len(t.config.SelectedRepositoryIDs) == 0 {
+			return fmt.Errorf("GitHub selected visibility requires selected_repository_ids")
+		}
+	default:
+		return fmt.Errorf("unknown GitHub visibility %s, must be one of all, private or selected", t.config.Visibility)
+	}
+	if t.config.Visibility != "" && t.config.Organization == "" {
+		return fmt.Errorf("GitHub visibility only applies to organization secrets")
+	}
+	if t.client == nil || t.client.Token == "" {
+		return fmt.Errorf("GitHub is configured but no token was provided")
+	}
+	return nil
+}
+
+func (t gitHubTarget) TokenOptions() target.TokenOptions {
+	return t.config.tokenOptions(t.config.VaultRole, t.config.VaultPolicies)
+}
+
+func (t gitHubTarget) SetVariables(ctx context.Context, vars []target.Variable) error {
+	for _, v := range vars {
+		var err error
+		switch {
+		case t.config.Organization != "":
+			err = t.client.SetOrgSecret(ctx, t.config.Organization, v.Key, v.Value, t.config.Visibility, t.config.SelectedRepositoryIDs)
+		case t.config.Environment != "":
+			err = t.client.SetEnvironmentSecret(ctx, t.config.Repository, t.config.Environment, v.Key, v.Value)
+		default:
+			err = t.client.SetRepoSecret(ctx, t.config.Repository, v.Key, v.Value)
+		}
+		if err != nil {
+			return fmt.Errorf("error setting %s: %w", v.Key, err)
+		}
+	}
+	return nil
+}
+
+func (t gitHubTarget) Check(ctx context.Context) error {
+	switch {
+	case t.config.Organization != "":
+		return t.client.CheckOrgSecrets(ctx, t.config.Organization)
+	case t.config.Environment != "":
+		return t.client.CheckEnvironmentSecrets(ctx, t.config.Repository, t.config.Environment)
+	default:
+		return t.client.CheckRepoSecrets(ctx, t.config.Repository)
+	}
+}
+
+// gitLabTarget is a GitLab project or group
+type gitLabTarget struct {
+	config GitLabConfig
+	client *gitlab.Client
+}
+
+func (t gitLabTarget) Provider() string {
+	return providerGitLab
+}
+
+func (t gitLabTarget) Name() string {
+	if t.config.Group != "" {
+		return t.config.Group
+	}
+	return t.config.Project
+}
+
+func (t gitLabTarget) Validate() error {
+	if t.config.Project == "" && t.config.Group == "" {
+		return fmt.Errorf("GitLab project or group is required")
+	}
+	if t.config.Project != "" && t.config.Group != "" {
+		return fmt.Errorf("only one of GitLab project or group can be set")
+	}
+	if t.client == nil || t.client.Token == "" {
+		return fmt.Errorf("GitLab is configured but no token was provided")
+	}
+	return nil
+}
+
+func (t gitLabTarget) TokenOptions() target.TokenOptions {
+	return t.config.tokenOptions(t.config.VaultRole, t.config.VaultPolicies)
+}
+
+func (t gitLabTarget) SetVariables(ctx context.Context, vars []target.Variable) error {
+	for _, v := range vars {
+		variable := gitlab.Variable{
+			Key:       v.Key,
+			Value:     v.Value,
+			Masked:    v.Sensitive,
+			Protected: t.config.Protected,
+		}
+		var err error
+		if t.config.Group != "" {
+			err = t.client.SetGroupVariable(ctx, t.config.Group, variable)
+		} else {
+			err = t.client.SetProjectVariable(ctx, t.config.Project, variable)
+		}
+		if err != nil {
+			return fmt.Errorf("error setting %s: %w", v.Key, err)
+		}
+	}
+	return nil
+}
+
+func (t gitLabTarget) Check(ctx context.Context) error {
+	if t.config.Group != "" {
+		return t.client.CheckGroup(ctx, t.config.Group)
+	}
+	return t.client.CheckProject(ctx, t.config.Project)
+}
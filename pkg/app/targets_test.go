@@ -0,0 +1,206 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/fairwindsops/vault-token-injector/pkg/circleci"
+	"github.com/fairwindsops/vault-token-injector/pkg/github"
+	"github.com/fairwindsops/vault-token-injector/pkg/spacelift"
+	"github.com/fairwindsops/vault-token-injector/pkg/target"
+)
+
+func TestGitHubTargetValidate(t *testing.T) {
+	client := &github.Client{Token: "token"}
+	tests := []struct {
+		name    string
+		config  GitHubConfig
+		wantErr string
+	}{
+		{
+			name:   "selected repositories",
+			config: GitHubConfig{Organization: "org", Visibility: "selected", SelectedRepositoryIDs: []int64{1296269}},
+		},
+		{
+			name:    "selected without repositories",
+			config:  GitHubConfig{Organization: "org", Visibility: "selected"},
+			wantErr: "GitHub selected visibility requires selected_repository_ids",
+		},
+		{
+			name:    "repositories without selected",
+			config:  GitHubConfig{Organization: "org", SelectedRepositoryIDs: []int64{1296269}},
+			wantErr: "GitHub selected_repository_ids requires selected visibility",
+		},
+		{
+			name:    "unknown visibility",
+			config:  GitHubConfig{Organization: "org", Visibility: "public"},
+			wantErr: "unknown GitHub visibility public, must be one of all, private or selected",
+		},
+		{
+			name:    "visibility on a repository",
+			config:  GitHubConfig{Repository: "org/repo", Visibility: "all"},
+			wantErr: "GitHub visibility only applies to organization secrets",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := gitHubTarget{config: tt.config, client: client}.Validate()
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCircleCITargetSlugs(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.RequestURI())
+		switch r.Method {
+		case http.MethodGet:
+			w.Write([]byte(`{"items": [{"id": "ctx-1", "name": "deploy"}]}`))
+		case http.MethodPost:
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer server.Close()
+
+	a := &App{
+		CircleToken: "token",
+		Config:      &Config{CircleCIURL: server.URL, CircleCIVCSType: "bb"},
+	}
+	vars := []target.Variable{{Key: "VAULT_TOKEN", Value: "hvs.1"}}
+	tests := []struct {
+		name    string
+		config  CircleCIConfig
+		wantReq []string
+	}{
+		{
+			name:    "global vcs type",
+			config:  CircleCIConfig{Name: "org/repo"},
+			wantReq: []string{"POST /api/v2/project/bb/org/repo/envvar"},
+		},
+		{
+			name:    "circleci vcs type",
+			config:  CircleCIConfig{Name: "0c4ab5a1/2d1c6f0e", VCSType: circleci.VCSTypeCircleCI},
+			wantReq: []string{"POST /api/v2/project/circleci/0c4ab5a1/2d1c6f0e/envvar"},
+		},
+		{
+			name:   "circleci vcs type context",
+			config: CircleCIConfig{Context: "deploy", Organization: "0c4ab5a1", VCSType: circleci.VCSTypeCircleCI},
+			wantReq: []string{
+				"GET /api/v2/context?owner-id=0c4ab5a1",
+				"PUT /api/v2/context/ctx-1/environment-variable/VAULT_TOKEN",
+			},
+		},
+		{
+			name:   "global vcs type context",
+			config: CircleCIConfig{Context: "deploy", Organization: "org"},
+			wantReq: []string{
+				"GET /api/v2/context?owner-slug=bb%2Forg",
+				"PUT /api/v2/context/ctx-1/environment-variable/VAULT_TOKEN",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests = nil
+			assert.NoError(t, a.newCircleCITarget(tt.config).SetVariables(t.Context(), vars))
+			assert.Equal(t, tt.wantReq, requests)
+		})
+	}
+
+	// A project can point at another CircleCI Server
+	other := a.newCircleCITarget(CircleCIConfig{Name: "org/repo", URL: "https://circleci.example.com", VCSType: "gh"})
+	assert.Equal(t, "https://circleci.example.com", other.client.URL)
+	assert.Equal(t, "gh", other.vcsType)
+}
+
+func TestTFCloudDiscovery(t *testing.T) {
+	// Both organizations have a workspace called app
+	workspaces := map[string]string{
+		"org-a": `[{"type": "workspaces", "id": "ws-1", "attributes": {"name": "app"}}, {"type": "workspaces", "id": "ws-2", "attributes": {"name": "api"}}]`,
+		"org-b": `[{"type": "workspaces", "id": "ws-3", "attributes": {"name": "app"}}]`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		org := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v2/organizations/"), "/workspaces")
+		data, ok := workspaces[org]
+		if !ok {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		fmt.Fprintf(w, `{"data": %s, "meta": {"pagination": {"current-page": 1, "next-page": 0}}}`, data)
+	}))
+	defer server.Close()
+
+	role := "ci"
+	a := &App{
+		TFCloudToken: "token",
+		Config: &Config{
+			TFCloudAddress: server.URL,
+			// ws-2 is also listed in the config file
+			TFCloud: []TFCloudConfig{{Workspace: "ws-2", VaultRole: &role}},
+			TFCloudDiscovery: []TFCloudDiscoveryConfig{
+				{Organization: "org-a", Tags: []string{"vault"}, VaultRole: &role},
+				{Organization: "org-b", Tags: []string{"vault"}, VaultRole: &role},
+				// Matches the same workspace as the selector before it
+				{Organization: "org-b", NameRegex: "^app$", VaultRole: &role},
+			},
+		},
+	}
+	targets, err := tfCloudDiscoveryProvider{app: a, selectors: a.Config.TFCloudDiscovery}.Targets(t.Context())
+	assert.NoError(t, err)
+	var ids []string
+	for _, discovered := range targets {
+		ids = append(ids, target.ID(discovered))
+		assert.NoError(t, discovered.Validate())
+	}
+	assert.Equal(t, []string{"tfcloud/org-a/ws-1", "tfcloud/org-b/ws-3"}, ids)
+	assert.Equal(t, "ws-3", targets[1].(tfCloudTarget).config.Workspace)
+}
+
+func TestSpaceliftDiscovery(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "apiKeyUser") {
+			w.Write([]byte(`{"data": {"apiKeyUser": {"id": "key", "jwt": "jwt"}}}`))
+			return
+		}
+		w.Write([]byte(`{"data": {"stacks": [
+			{"id": "app-prod", "labels": ["vault", "prod"], "spaceDetails": {"id": "root", "name": "root"}},
+			{"id": "app-dev", "labels": ["vault"], "spaceDetails": {"id": "root", "name": "root"}}
+		]}}`))
+	}))
+	defer server.Close()
+
+	role := "ci"
+	client := &spacelift.Client{URL: server.URL, APIKeyID: "key", APIKeySecret: "secret"}
+	provider := spaceliftDiscoveryProvider{
+		client: client,
+		selectors: []SpaceliftDiscoveryConfig{
+			{Labels: []string{"vault"}, VaultRole: &role},
+			// Matches a stack the selector before it already matched
+			{Labels: []string{"prod"}, VaultRole: &role},
+		},
+		// app-dev is also listed in the config file
+		configured: []SpaceliftConfig{{Stack: "app-dev", VaultRole: &role}},
+	}
+	targets, err := provider.Targets(t.Context())
+	assert.NoError(t, err)
+	var ids []string
+	for _, discovered := range targets {
+		ids = append(ids, target.ID(discovered))
+	}
+	assert.Equal(t, []string{"spacelift/app-prod"}, ids)
+}
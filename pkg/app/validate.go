@@ -0,0 +1,447 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/fairwindsops/vault-token-injector/pkg/target"
+)
+
+// Problem is a single problem found in the config
+type Problem struct {
+	// File is the config file the problem is in, if known
+	File string
+	// Line is the line of the config file the problem is on, or 0 if it is not known
+	Line int
+	// Path is the location of the problem in the config, e.g. tfcloud[2].workspace
+	Path string
+	// Message describes the problem
+	Message string
+}
+
+func (p Problem) String() string {
+	location := p.File
+	if p.Line > 0 {
+		location = fmt.Sprintf("%s:%d", p.File, p.Line)
+	}
+	if location == "" {
+		return fmt.Sprintf("%s: %s", p.Path, p.Message)
+	}
+	if p.Path == "" {
+		return fmt.Sprintf("%s: %s", location, p.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", location, p.Path, p.Message)
+}
+
+// ValidationError is returned when the config has problems. It lists all of them
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, 0, len(e.Problems)+1)
+	lines = append(lines, fmt.Sprintf("the config has %d problems:", len(e.Problems)))
+	for _, p := range e.Problems {
+		lines = append(lines, "  "+p.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Validate checks the config files for unknown fields and values of the wrong type,
+// and then checks the loaded config for targets that are invalid, duplicated, or
+// missing credentials. Every problem found is returned in a *ValidationError. The
+// files are those the config was merged from, in order, and are optional. Without
+// them only the loaded config is checked, and problems have no positions.
+func (a *App) Validate(files ...string) error {
+	positions := &configPositions{paths: map[string]position{}, offsets: map[string]int{}}
+	var problems []Problem
+	for _, file := range files {
+		problems = append(problems, positions.checkFile(file)...)
+	}
+	for _, p := range a.configProblems(positions) {
+		if len(files) == 1 {
+			p.File = files[0]
+		}
+		problems = append(problems, positions.locate(p))
+	}
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// position is a line in a config file
+type position struct {
+	file string
+	line int
+}
+
+// configPositions maps paths in the merged config to where they are in the config files
+type configPositions struct {
+	// file is the file being checked
+	file  string
+	paths map[string]position
+	// offsets is the number of items of each list in the files checked so far, as
+	// lists from each file are appended to each other when they are merged
+	offsets map[string]int
+}
+
+// locate fills in the file and line of a problem, using the closest parent path if
+// the path itself is not in the files
+func (c *configPositions) locate(p Problem) Problem {
+	for path := p.Path; path != ""; path = parentPath(path) {
+		if pos, ok := c.paths[path]; ok {
+			p.File = pos.file
+			p.Line = pos.line
+			break
+		}
+	}
+	return p
+}
+
+// describe returns where a path is in the config files, or the path itself if that is not known
+func (c *configPositions) describe(path string) string {
+	if pos, ok := c.paths[path]; ok {
+		return fmt.Sprintf("%s:%d", pos.file, pos.line)
+	}
+	return path
+}
+
+func parentPath(path string) string {
+	if i := strings.LastIndexAny(path, ".["); i > 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+// checkFile parses a config file and checks every field in it against Config
+func (c *configPositions) checkFile(file string) []Problem {
+	c.file = file
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return []Problem{{File: file, Message: fmt.Sprintf("could not read config file: %s", err.Error())}}
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return []Problem{{File: file, Message: fmt.Sprintf("could not parse config file: %s", err.Error())}}
+	}
+	if len(root.Content) == 0 {
+		return nil
+	}
+	return c.check(root.Content[0], reflect.TypeOf(Config{}), "")
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// check compares a node of the config file with the type it is decoded into
+func (c *configPositions) check(node *yaml.Node, t reflect.Type, path string) []Problem {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Tag == "!!null" {
+		return nil
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	problem := func(format string, args ...interface{}) []Problem {
+		return []Problem{{File: c.file, Line: node.Line, Path: path, Message: fmt.Sprintf(format, args...)}}
+	}
+
+	switch {
+	case t == durationType:
+		if node.Kind != yaml.ScalarNode {
+			return problem("expected a duration such as 30m")
+		}
+		if _, err := time.ParseDuration(node.Value); err != nil {
+			return problem("invalid duration %q, expected a duration such as 30m", node.Value)
+		}
+		return nil
+	case t.Kind() == reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return problem("expected a map")
+		}
+		return c.checkFields(node, t, path)
+	case t.Kind() == reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return problem("expected a list")
+		}
+		var problems []Problem
+		offset := c.offsets[path]
+		for i, item := range node.Content {
+			itemPath := fmt.Sprintf("%s[%d]", path, offset+i)
+			c.paths[itemPath] = position{file: c.file, line: item.Line}
+			problems = append(problems, c.check(item, t.Elem(), itemPath)...)
+		}
+		c.offsets[path] += len(node.Content)
+		return problems
+	case t.Kind() == reflect.Bool:
+		if node.Kind != yaml.ScalarNode || node.Tag != "!!bool" {
+			return problem("expected true or false")
+		}
+	case t.Kind() == reflect.Int:
+		if node.Kind != yaml.ScalarNode || node.Tag != "!!int" {
+			return problem("expected a whole number")
+		}
+	case t.Kind() == reflect.Float64:
+		if node.Kind != yaml.ScalarNode || (node.Tag != "!!float" && node.Tag != "!!int") {
+			return problem("expected a number")
+		}
+	case t.Kind() == reflect.String:
+		if node.Kind != yaml.ScalarNode {
+			return problem("expected a string")
+		}
+	}
+	return nil
+}
+
+// checkFields checks each key of a map against the fields of a struct
+func (c *configPositions) checkFields(node *yaml.Node, t reflect.Type, path string) []Problem {
+	fields := map[string]reflect.Type{}
+	collectFields(t, fields)
+	var problems []Problem
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		name := strings.ToLower(key.Value)
+		fieldPath := name
+		if path != "" {
+			fieldPath = path + "." + name
+		}
+		c.paths[fieldPath] = position{file: c.file, line: key.Line}
+		fieldType, ok := fields[name]
+		if !ok {
+			message := fmt.Sprintf("unknown field %q", key.Value)
+			if suggestion := closestField(name, fields); suggestion != "" {
+				message += fmt.Sprintf(", did you mean %q?", suggestion)
+			}
+			problems = append(problems, Problem{File: c.file, Line: key.Line, Path: fieldPath, Message: message})
+			continue
+		}
+		problems = append(problems, c.check(value, fieldType, fieldPath)...)
+	}
+	return problems
+}
+
+// collectFields finds the config key of every field of a struct, including the
+// fields of squashed structs
+func collectFields(t reflect.Type, fields map[string]reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, options, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+		if options == "squash" {
+			collectFields(field.Type, fields)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[strings.ToLower(name)] = field.Type
+	}
+}
+
+// closestField returns the field that is within two edits of name, if there is one
+func closestField(name string, fields map[string]reflect.Type) string {
+	best, bestDistance := "", 3
+	for field := range fields {
+		if distance := editDistance(name, field); distance < bestDistance || (distance == bestDistance && field < best) {
+			best, bestDistance = field, distance
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+// configProblems checks the loaded config. The problems have a path but no position
+func (a *App) configProblems(positions *configPositions) []Problem {
+	var problems []Problem
+	add := func(path, format string, args ...interface{}) {
+		problems = append(problems, Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+	config := a.Config
+
+	if config.VaultAddress == "" {
+		add("vault_address", "vault_address is required")
+	}
+	// Unset durations have been given their defaults by now, so these are only
+	// zero or negative if they were set that way
+	for _, d := range []struct {
+		path  string
+		value time.Duration
+	}{
+		{"token_ttl", config.TokenTTL},
+		{"token_refresh_interval", config.TokenRefreshInterval},
+		{"shutdown_timeout", config.ShutdownTimeout},
+	} {
+		if d.value <= 0 {
+			add(d.path, "%s must be positive, got %s", d.path, d.value.String())
+		}
+	}
+	for _, d := range []struct {
+		path  string
+		value time.Duration
+	}{
+		{"revoke_grace_period", config.RevokeGracePeriod},
+		{"refresh_stagger_window", config.RefreshStaggerWindow},
+		{"retry.initial_backoff", config.Retry.InitialBackoff},
+		{"retry.max_backoff", config.Retry.MaxBackoff},
+		{"leader_election.lease_duration", config.LeaderElection.LeaseDuration},
+		{"leader_election.renew_deadline", config.LeaderElection.RenewDeadline},
+		{"leader_election.retry_period", config.LeaderElection.RetryPeriod},
+		{"controller.resync_interval", config.Controller.ResyncInterval},
+	} {
+		if d.value < 0 {
+			add(d.path, "%s must not be negative, got %s", d.path, d.value.String())
+		}
+	}
+	if config.Retry.Jitter != nil && *config.Retry.Jitter < 0 {
+		add("retry.jitter", "retry.jitter must not be negative")
+	}
+	if config.TokenTTL > 0 && config.TokenTTL < config.TokenRefreshInterval {
+		add("token_ttl", "token_ttl %s is shorter than token_refresh_interval %s, so tokens would expire before they are refreshed", config.TokenTTL.String(), config.TokenRefreshInterval.String())
+	}
+	if config.RefreshJitter < 0 || config.RefreshJitter >= 1 {
+		add("refresh_jitter", "refresh_jitter must be at least 0 and less than 1")
+	}
+	if config.RotationThreshold < 0 || config.RotationThreshold > 1 {
+		add("rotation_threshold", "rotation_threshold must be between 0 and 1")
+	}
+	switch config.VaultAuth.Method {
+	case "", vaultAuthToken, vaultAuthKubernetes, vaultAuthAppRole:
+	default:
+		add("vault_auth.method", "unknown vault auth method %q", config.VaultAuth.Method)
+	}
+	if _, err := a.elector(); err != nil {
+		add("leader_election.method", "%s", err.Error())
+	}
+	if config.LeaderElection.Method == leaderElectionFile && config.LeaderElection.LockFile == "" {
+		add("leader_election", "file leader election requires a lock_file")
+	}
+	if _, err := newStateStore(config.State); err != nil {
+		add("state", "%s", err.Error())
+	}
+	if config.Controller.Enabled && len(config.Controller.Namespaces) == 0 {
+		add("controller", "the controller requires at least one namespace")
+	}
+	for i, namespace := range config.Controller.Namespaces {
+		path := fmt.Sprintf("controller.namespaces[%d]", i)
+		if namespace.Namespace == "" {
+			add(path, "namespace is required")
+		}
+		if len(namespace.VaultRoles) == 0 && len(namespace.VaultPolicies) == 0 {
+			add(path, "neither vault_roles nor vault_policies is set, so no resources in the namespace could be injected")
+		}
+	}
+
+	// Each target is checked with the same validation that is run before injecting into it
+	seen := map[string]string{}
+	checkTarget := func(path string, t target.Target, role *string, policies []string) {
+		if err := t.Validate(); err != nil {
+			add(path, "%s", err.Error())
+		}
+		a.checkTokenSettings(path, t.TokenOptions(), role, policies, add)
+		id := destination(t)
+		if first, ok := seen[id]; ok {
+			add(path, "duplicate target %s, it is already configured at %s", id, positions.describe(first))
+			return
+		}
+		seen[id] = path
+	}
+	for i, project := range config.CircleCI {
+		checkTarget(fmt.Sprintf("circleci[%d]", i), a.newCircleCITarget(project), project.VaultRole, project.VaultPolicies)
+	}
+	for i, workspace := range config.TFCloud {
+		path := fmt.Sprintf("tfcloud[%d]", i)
+		if workspace.Workspace != "" && !strings.HasPrefix(workspace.Workspace, "ws-") {
+			add(path+".workspace", "workspace must be a workspace ID starting with ws-, got %q", workspace.Workspace)
+		}
+		checkTarget(path, a.newTFCloudTarget(workspace), workspace.VaultRole, workspace.VaultPolicies)
+	}
+	for i, stack := range config.Spacelift {
+		checkTarget(fmt.Sprintf("spacelift[%d]", i), spaceliftTarget{config: stack, client: a.SpaceliftClient}, stack.VaultRole, stack.VaultPolicies)
+	}
+	for i, repo := range config.GitHub {
+		checkTarget(fmt.Sprintf("github[%d]", i), gitHubTarget{config: repo, client: a.GitHubClient}, repo.VaultRole, repo.VaultPolicies)
+	}
+	for i, project := range config.GitLab {
+		checkTarget(fmt.Sprintf("gitlab[%d]", i), gitLabTarget{config: project, client: a.GitLabClient}, project.VaultRole, project.VaultPolicies)
+	}
+
+	for i, selector := range config.TFCloudDiscovery {
+		path := fmt.Sprintf("tfcloud_discovery[%d]", i)
+		if selector.Organization == "" {
+			add(path, "TFCloud discovery requires an organization")
+		}
+		if len(selector.Tags) == 0 && selector.Project == "" && selector.NameRegex == "" {
+			add(path, "TFCloud discovery requires tags, a project, or a name regex")
+		}
+		if selector.NameRegex != "" {
+			if _, err := regexp.Compile(selector.NameRegex); err != nil {
+				add(path+".name_regex", "invalid workspace name regex: %s", err.Error())
+			}
+		}
+		if a.TFCloudToken == "" {
+			add(path, "TFCloud discovery is configured but no token was provided")
+		}
+		a.checkTokenSettings(path, selector.tokenOptions(selector.VaultRole, selector.VaultPolicies), selector.VaultRole, selector.VaultPolicies, add)
+	}
+	for i, selector := range config.SpaceliftDiscovery {
+		path := fmt.Sprintf("spacelift_discovery[%d]", i)
+		if len(selector.Labels) == 0 && len(selector.Spaces) == 0 {
+			add(path, "Spacelift discovery requires labels or spaces")
+		}
+		if a.SpaceliftClient == nil || a.SpaceliftClient.URL == "" || a.SpaceliftClient.APIKeyID == "" || a.SpaceliftClient.APIKeySecret == "" {
+			add(path, "Spacelift discovery is configured but no Spacelift URL and API key were provided")
+		}
+		a.checkTokenSettings(path, selector.tokenOptions(selector.VaultRole, selector.VaultPolicies), selector.VaultRole, selector.VaultPolicies, add)
+	}
+	return problems
+}
+
+// checkTokenSettings checks that a target gets a role or policies, that its token
+// settings are not negative, and that its token lives longer than its refresh interval
+func (a *App) checkTokenSettings(path string, opts target.TokenOptions, role *string, policies []string, add func(path, format string, args ...interface{})) {
+	if role == nil && len(policies) == 0 {
+		add(path, "neither vault_role nor vault_policies is set")
+	}
+	if opts.TTL < 0 {
+		add(path+".token_ttl", "token_ttl must be positive, got %s", opts.TTL.String())
+	}
+	if opts.RefreshInterval < 0 {
+		add(path+".token_refresh_interval", "token_refresh_interval must be positive, got %s", opts.RefreshInterval.String())
+	}
+	if opts.TTL < 0 || opts.RefreshInterval < 0 {
+		return
+	}
+	settings := a.tokenSettings(opts)
+	if settings.TTL < settings.RefreshInterval && (opts.TTL != 0 || opts.RefreshInterval != 0) {
+		add(path, "token_ttl %s is shorter than token_refresh_interval %s, so tokens would expire before they are refreshed", settings.TTL.String(), settings.RefreshInterval.String())
+	}
+}
@@ -0,0 +1,156 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/fairwindsops/vault-token-injector/pkg/gitlab"
+)
+
+func TestValidate(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(file, []byte(`vault_address: https://vault.example.com
+token_ttl: 10m
+token_refresh_interval: 1hour
+tfcloud:
+  - workspace: my-workspace
+    vault_polices:
+      - ci
+gitlab:
+  - project: group/app
+    vault_role: ci
+  - project: group/app
+    vault_role: ci
+`), 0o644)
+	assert.NoError(t, err)
+
+	role := "ci"
+	a := &App{
+		TFCloudToken: "token",
+		GitLabClient: &gitlab.Client{Token: "token"},
+		Config: &Config{
+			VaultAddress:         "https://vault.example.com",
+			TokenTTL:             10 * time.Minute,
+			TokenRefreshInterval: 30 * time.Minute,
+			RefreshStaggerWindow: 30 * time.Minute,
+			ShutdownTimeout:      30 * time.Second,
+			TFCloud:              []TFCloudConfig{{Workspace: "my-workspace"}},
+			GitLab: []GitLabConfig{
+				{Project: "group/app", VaultRole: &role},
+				{Project: "group/app", VaultRole: &role},
+			},
+		},
+	}
+	err = a.Validate(file)
+	var validationErr *ValidationError
+	assert.ErrorAs(t, err, &validationErr)
+
+	want := []Problem{
+		{File: file, Line: 3, Path: "token_refresh_interval", Message: `invalid duration "1hour", expected a duration such as 30m`},
+		{File: file, Line: 6, Path: "tfcloud[0].vault_polices", Message: `unknown field "vault_polices", did you mean "vault_policies"?`},
+		{File: file, Line: 2, Path: "token_ttl", Message: "token_ttl 10m0s is shorter than token_refresh_interval 30m0s, so tokens would expire before they are refreshed"},
+		{File: file, Line: 5, Path: "tfcloud[0].workspace", Message: `workspace must be a workspace ID starting with ws-, got "my-workspace"`},
+		{File: file, Line: 5, Path: "tfcloud[0]", Message: "neither vault_role nor vault_policies is set"},
+		{File: file, Line: 11, Path: "gitlab[1]", Message: "duplicate target gitlab/group/app, it is already configured at " + file + ":9"},
+	}
+	assert.Equal(t, want, validationErr.Problems)
+}
+
+func TestValidateDurations(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(file, []byte(`vault_address: https://vault.example.com
+token_refresh_interval: -5m
+revoke_grace_period: -1m
+gitlab:
+  - project: group/app
+    vault_role: ci
+    token_refresh_interval: -1h
+  - project: group/other
+    vault_role: ci
+    token_ttl: 0s
+`), 0o644)
+	assert.NoError(t, err)
+
+	role := "ci"
+	a := &App{
+		GitLabClient: &gitlab.Client{Token: "token"},
+		Config: &Config{
+			VaultAddress:         "https://vault.example.com",
+			TokenTTL:             time.Hour,
+			TokenRefreshInterval: -5 * time.Minute,
+			RevokeGracePeriod:    -time.Minute,
+			ShutdownTimeout:      30 * time.Second,
+			GitLab: []GitLabConfig{
+				{Project: "group/app", VaultRole: &role, TokenOverrides: TokenOverrides{TokenRefreshInterval: -time.Hour}},
+				{Project: "group/other", VaultRole: &role},
+			},
+		},
+	}
+	err = a.Validate(file)
+	var validationErr *ValidationError
+	assert.ErrorAs(t, err, &validationErr)
+
+	want := []Problem{
+		{File: file, Line: 2, Path: "token_refresh_interval", Message: "token_refresh_interval must be positive, got -5m0s"},
+		{File: file, Line: 3, Path: "revoke_grace_period", Message: "revoke_grace_period must not be negative, got -1m0s"},
+		{File: file, Line: 7, Path: "gitlab[0].token_refresh_interval", Message: "token_refresh_interval must be positive, got -1h0m0s"},
+	}
+	assert.Equal(t, want, validationErr.Problems)
+}
+
+func TestValidateTFCloud(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(file, []byte(`vault_address: https://vault.example.com
+tfcloud:
+  - workspace: ws-1
+    name: prod
+    vault_role: ci
+  - workspace: ws-1
+    name: production
+    vault_role: ci
+  - variable_set: shared
+    organization: org
+    vault_role: ci
+  - variable_set: shared
+    organization: org
+    name: mine
+    vault_role: ci
+tfcloud_discovery:
+  - organization: org
+    name_regex: "prod-("
+    vault_role: ci
+`), 0o644)
+	assert.NoError(t, err)
+
+	role := "ci"
+	a := &App{
+		TFCloudToken: "token",
+		Config: &Config{
+			VaultAddress:         "https://vault.example.com",
+			TokenTTL:             time.Hour,
+			TokenRefreshInterval: 30 * time.Minute,
+			ShutdownTimeout:      30 * time.Second,
+			TFCloud: []TFCloudConfig{
+				{Workspace: "ws-1", Name: "prod", VaultRole: &role},
+				{Workspace: "ws-1", Name: "production", VaultRole: &role},
+				{VariableSet: "shared", Organization: "org", VaultRole: &role},
+				{VariableSet: "shared", Organization: "org", Name: "mine", VaultRole: &role},
+			},
+			TFCloudDiscovery: []TFCloudDiscoveryConfig{{Organization: "org", NameRegex: "prod-(", VaultRole: &role}},
+		},
+	}
+	err = a.Validate(file)
+	var validationErr *ValidationError
+	assert.ErrorAs(t, err, &validationErr)
+
+	want := []Problem{
+		{File: file, Line: 6, Path: "tfcloud[1]", Message: "duplicate target tfcloud/ws-1, it is already configured at " + file + ":3"},
+		{File: file, Line: 12, Path: "tfcloud[3]", Message: "duplicate target tfcloud/varset:org/shared, it is already configured at " + file + ":9"},
+		{File: file, Line: 18, Path: "tfcloud_discovery[0].name_regex", Message: "invalid workspace name regex: error parsing regexp: missing closing ): `prod-(`"},
+	}
+	assert.Equal(t, want, validationErr.Problems)
+}
@@ -1,30 +1,66 @@
 package circleci
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"k8s.io/klog/v2"
+
+	"github.com/fairwindsops/vault-token-injector/pkg/retry"
+)
+
+const (
+	// DefaultURL is the CircleCI cloud URL
+	DefaultURL = "https://circleci.com"
+	// DefaultVCSType is the VCS type used in project slugs when none is configured
+	DefaultVCSType = "gh"
+	// VCSTypeCircleCI is the VCS type of organizations that are not backed by GitHub or Bitbucket
+	VCSTypeCircleCI = "circleci"
 )
 
-func UpdateEnvVar(projName, env_variable_name, env_variable_value, circleToken string) error {
-	klog.Infof("setting env var %s in CircleCI project %s", env_variable_name, projName)
-	url := fmt.Sprintf("https://circleci.com/api/v2/project/gh/%s/envvar", projName)
+// httpClient retries rate limited and failed requests
+var httpClient = retry.NewClient(time.Second * 10)
+
+type Client struct {
+	// Token is a CircleCI personal API token
+	Token string
+	// URL is the CircleCI URL. Defaults to https://circleci.com, set it for CircleCI Server
+	URL string
+}
+
+func (c Client) apiURL(path string) string {
+	baseURL := c.URL
+	if baseURL == "" {
+		baseURL = DefaultURL
+	}
+	return strings.TrimSuffix(baseURL, "/") + "/api/v2" + path
+}
+
+// UpdateEnvVar sets an env var in the project with the given slug, e.g. gh/org/repo
+func (c Client) UpdateEnvVar(ctx context.Context, projectSlug, env_variable_name, env_variable_value string) error {
+	klog.Infof("setting env var %s in CircleCI project %s", env_variable_name, projectSlug)
+	url := c.apiURL(fmt.Sprintf("/project/%s/envvar", projectSlug))
 	payload := strings.NewReader(fmt.Sprintf("{\"name\":\"%s\",\"value\":\"%s\"}", env_variable_name, env_variable_value))
 
-	req, err := http.NewRequest("POST", url, payload)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, payload)
 	if err != nil {
 		return err
 	}
 
 	req.Header.Add("content-type", "application/json")
-	req.Header.Add("Circle-Token", circleToken)
+	req.Header.Add("Circle-Token", c.Token)
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := httpClient.Do(req)
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
 
 	if err := handleCircleRateLimit(res); err != nil {
 		return err
@@ -37,23 +73,147 @@ func UpdateEnvVar(projName, env_variable_name, env_variable_value, circleToken s
 	return nil
 }
 
+// CheckProject makes sure the project exists and its env vars can be listed, without changing anything
+func (c Client) CheckProject(ctx context.Context, projectSlug string) error {
+	return c.check(ctx, fmt.Sprintf("/project/%s/envvar", projectSlug), "project "+projectSlug)
+}
+
+// CheckContext makes sure the context exists and its env vars can be listed, without changing anything
+func (c Client) CheckContext(ctx context.Context, vcsType, org, contextName string) error {
+	contextID, err := c.GetContextID(ctx, vcsType, org, contextName)
+	if err != nil {
+		return err
+	}
+	return c.check(ctx, fmt.Sprintf("/context/%s/environment-variable", contextID), "context "+contextName)
+}
+
+func (c Client) check(ctx context.Context, path, description string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.apiURL(path), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Circle-Token", c.Token)
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if err := handleCircleRateLimit(res); err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed reading CircleCI %s. Status Code returned: %d", description, res.StatusCode)
+	}
+	return nil
+}
+
 // handleCircleRateLimit handles these https://circleci.com/docs/api-developers-guide/#rate-limits
+// Rate limited requests have already been retried by the time this is called, so
+// a 429 here means the retries were exhausted.
 func handleCircleRateLimit(response *http.Response) error {
-	if response.StatusCode != 429 {
+	if response.StatusCode != http.StatusTooManyRequests {
 		return nil
 	}
-	rateLimitHeaders := map[string]string{
-		"RateLimit-Limit":   "",
-		"X-RateLimit-Limit": "",
-		"RateLimit-Reset":   "",
-		"X-RateLimit-Reset": "",
+	rateLimitHeaders := map[string]string{}
+	for _, header := range []string{"RateLimit-Limit", "X-RateLimit-Limit", "RateLimit-Reset", "X-RateLimit-Reset", "Retry-After"} {
+		rateLimitHeaders[header] = response.Header.Get(header)
 	}
 
-	for header, value := range rateLimitHeaders {
-		rateLimitHeaders[value] = response.Header.Get(header)
+	klog.Warningf("rate limit encountered %v", rateLimitHeaders)
+
+	return fmt.Errorf("rate limited by CircleCI, retry after %s", retry.RetryAfter(response).String())
+}
+
+type contextList struct {
+	Items []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"items"`
+	NextPageToken string `json:"next_page_token"`
+}
+
+// GetContextID looks up the ID of the context with the given name in an organization.
+// For organizations with the circleci VCS type, org must be the organization ID.
+func (c Client) GetContextID(ctx context.Context, vcsType, org, contextName string) (string, error) {
+	pageToken := ""
+	for {
+		query := url.Values{}
+		if vcsType == VCSTypeCircleCI {
+			query.Set("owner-id", org)
+		} else {
+			query.Set("owner-slug", fmt.Sprintf("%s/%s", vcsType, org))
+		}
+		if pageToken != "" {
+			query.Set("page-token", pageToken)
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", c.apiURL("/context?"+query.Encode()), nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Add("Circle-Token", c.Token)
+
+		res, err := httpClient.Do(req)
+		if err != nil {
+			return "", err
+		}
+		if err := handleCircleRateLimit(res); err != nil {
+			res.Body.Close()
+			return "", err
+		}
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return "", fmt.Errorf("Failed listing CircleCI contexts. Status Code returned: %d", res.StatusCode)
+		}
+		contexts := contextList{}
+		err = json.NewDecoder(res.Body).Decode(&contexts)
+		res.Body.Close()
+		if err != nil {
+			return "", fmt.Errorf("could not parse CircleCI contexts: %s", err.Error())
+		}
+
+		for _, context := range contexts.Items {
+			if context.Name == contextName {
+				return context.ID, nil
+			}
+		}
+		if contexts.NextPageToken == "" {
+			return "", fmt.Errorf("could not find CircleCI context %s in organization %s", contextName, org)
+		}
+		pageToken = contexts.NextPageToken
 	}
+}
 
-	klog.Warningf("rate limit encountered %v", rateLimitHeaders)
+// UpdateContextEnvVar creates or updates an env var in the context with the given ID
+func (c Client) UpdateContextEnvVar(ctx context.Context, contextID, env_variable_name, env_variable_value string) error {
+	klog.Infof("setting env var %s in CircleCI context %s", env_variable_name, contextID)
+	url := c.apiURL(fmt.Sprintf("/context/%s/environment-variable/%s", contextID, env_variable_name))
+	payload, err := json.Marshal(map[string]string{"value": env_variable_value})
+	if err != nil {
+		return err
+	}
 
+	req, err := http.NewRequestWithContext(ctx, "PUT", url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("content-type", "application/json")
+	req.Header.Add("Circle-Token", c.Token)
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if err := handleCircleRateLimit(res); err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed updating CircleCI context. Status Code returned: %d", res.StatusCode)
+	}
 	return nil
 }
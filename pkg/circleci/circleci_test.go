@@ -0,0 +1,149 @@
+package circleci
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeCircleCI lists contexts one per page and records env var writes by path
+type fakeCircleCI struct {
+	// contexts are keyed by the owner-slug or owner-id query
+	contexts map[string][]string
+	envVars  map[string]string
+	queries  []string
+}
+
+func (f *fakeCircleCI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Circle-Token") != "circle-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/api/v2")
+	switch {
+	case r.Method == http.MethodGet && path == "/context":
+		f.listContexts(w, r)
+	case r.Method == http.MethodPost && strings.HasPrefix(path, "/project/") && strings.HasSuffix(path, "/envvar"):
+		var body struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.envVars[path+"/"+body.Name] = body.Value
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && strings.HasPrefix(path, "/context/"):
+		var body struct {
+			Value string `json:"value"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.envVars[path] = body.Value
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// listContexts serves one context per page, with the next index as the page token
+func (f *fakeCircleCI) listContexts(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	f.queries = append(f.queries, r.URL.RawQuery)
+	owner := "owner-slug=" + query.Get("owner-slug")
+	if query.Get("owner-id") != "" {
+		owner = "owner-id=" + query.Get("owner-id")
+	}
+	names := f.contexts[owner]
+	page := 0
+	if token := query.Get("page-token"); token != "" {
+		fmt.Sscanf(token, "%d", &page)
+	}
+	list := contextList{}
+	if page < len(names) {
+		list.Items = append(list.Items, struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		}{ID: fmt.Sprintf("ctx-%d", page+1), Name: names[page]})
+	}
+	if page+1 < len(names) {
+		list.NextPageToken = fmt.Sprintf("%d", page+1)
+	}
+	_ = json.NewEncoder(w).Encode(list)
+}
+
+func TestGetContextID(t *testing.T) {
+	fake := &fakeCircleCI{contexts: map[string][]string{"owner-slug=gh/org": {"build", "deploy", "release"}}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := Client{Token: "circle-token", URL: server.URL}
+
+	id, err := client.GetContextID(t.Context(), "gh", "org", "release")
+	assert.NoError(t, err)
+	assert.Equal(t, "ctx-3", id)
+	assert.Equal(t, []string{
+		"owner-slug=gh%2Forg",
+		"owner-slug=gh%2Forg&page-token=1",
+		"owner-slug=gh%2Forg&page-token=2",
+	}, fake.queries, "every page is read until the context is found")
+
+	_, err = client.GetContextID(t.Context(), "gh", "org", "missing")
+	assert.EqualError(t, err, "could not find CircleCI context missing in organization org")
+
+	_, err = Client{Token: "nope", URL: server.URL}.GetContextID(t.Context(), "gh", "org", "release")
+	assert.EqualError(t, err, "Failed listing CircleCI contexts. Status Code returned: 401")
+}
+
+func TestUpdateContextEnvVar(t *testing.T) {
+	fake := &fakeCircleCI{envVars: map[string]string{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := Client{Token: "circle-token", URL: server.URL}
+
+	// Setting an env var that already exists updates it
+	assert.NoError(t, client.UpdateContextEnvVar(t.Context(), "ctx-2", "VAULT_TOKEN", "hvs.1"))
+	assert.NoError(t, client.UpdateContextEnvVar(t.Context(), "ctx-2", "VAULT_TOKEN", "hvs.2"))
+	assert.Equal(t, map[string]string{
+		"/context/ctx-2/environment-variable/VAULT_TOKEN": "hvs.2",
+	}, fake.envVars)
+
+	err := Client{Token: "nope", URL: server.URL}.UpdateContextEnvVar(t.Context(), "ctx-2", "VAULT_TOKEN", "hvs.3")
+	assert.EqualError(t, err, "Failed updating CircleCI context. Status Code returned: 401")
+}
+
+func TestVCSTypes(t *testing.T) {
+	fake := &fakeCircleCI{
+		contexts: map[string][]string{"owner-id=0c4ab5a1-7f6b-4bb5-9b4b-6e1f0f3f2e2a": {"deploy"}},
+		envVars:  map[string]string{},
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	// CircleCI Server is reached through its own base URL
+	client := Client{Token: "circle-token", URL: server.URL + "/"}
+
+	assert.NoError(t, client.UpdateEnvVar(t.Context(), "bb/org/repo", "VAULT_TOKEN", "hvs.bb"))
+	assert.NoError(t, client.UpdateEnvVar(t.Context(), "circleci/0c4ab5a1/2d1c6f0e", "VAULT_TOKEN", "hvs.circleci"))
+	assert.Equal(t, map[string]string{
+		"/project/bb/org/repo/envvar/VAULT_TOKEN":                "hvs.bb",
+		"/project/circleci/0c4ab5a1/2d1c6f0e/envvar/VAULT_TOKEN": "hvs.circleci",
+	}, fake.envVars)
+
+	// Organizations with the circleci VCS type are looked up by ID
+	id, err := client.GetContextID(t.Context(), VCSTypeCircleCI, "0c4ab5a1-7f6b-4bb5-9b4b-6e1f0f3f2e2a", "deploy")
+	assert.NoError(t, err)
+	assert.Equal(t, "ctx-1", id)
+	assert.Equal(t, []string{"owner-id=0c4ab5a1-7f6b-4bb5-9b4b-6e1f0f3f2e2a"}, fake.queries)
+}
+
+func TestAPIURL(t *testing.T) {
+	assert.Equal(t, "https://circleci.com/api/v2/context", Client{}.apiURL("/context"))
+	assert.Equal(t, "https://circleci.example.com/api/v2/context", Client{URL: "https://circleci.example.com/"}.apiURL("/context"))
+}
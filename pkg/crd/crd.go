@@ -0,0 +1,146 @@
+package crd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/fairwindsops/vault-token-injector/pkg/kube"
+)
+
+const (
+	// Group is the API group of the VaultTokenInjection resource
+	Group = "vault-token-injector.fairwinds.com"
+	// Version is the API version of the VaultTokenInjection resource
+	Version = "v1alpha1"
+	// Kind is the kind of the VaultTokenInjection resource
+	Kind = "VaultTokenInjection"
+)
+
+// Resource is the VaultTokenInjection resource
+var Resource = schema.GroupVersionResource{Group: Group, Version: Version, Resource: "vaulttokeninjections"}
+
+// VaultTokenInjection declares a target to inject vault tokens into
+type VaultTokenInjection struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   VaultTokenInjectionSpec   `json:"spec"`
+	Status VaultTokenInjectionStatus `json:"status,omitempty"`
+}
+
+// VaultTokenInjectionSpec is the target and the token to inject into it
+type VaultTokenInjectionSpec struct {
+	// Provider is the provider of the target, e.g. circleci or tfcloud
+	Provider string `json:"provider"`
+	// Target identifies the target. It has the same fields as the provider's entries
+	// in the config file, such as name for circleci or workspace for tfcloud
+	Target map[string]interface{} `json:"target"`
+	// VaultRole is the vault role to use for the token
+	VaultRole *string `json:"vaultRole,omitempty"`
+	// VaultPolicies is a list of policies that will be given to the token
+	VaultPolicies []string `json:"vaultPolicies,omitempty"`
+	// TokenTTL overrides the TTL of the token
+	TokenTTL *metav1.Duration `json:"tokenTTL,omitempty"`
+	// TokenRefreshInterval overrides how often the token is refreshed
+	TokenRefreshInterval *metav1.Duration `json:"tokenRefreshInterval,omitempty"`
+	// TokenVariable overrides the name of the variable the token is written to
+	TokenVariable string `json:"tokenVariable,omitempty"`
+	// OrphanTokens overrides whether the token is created as an orphan. Orphan tokens must be allowed for the namespace
+	OrphanTokens *bool `json:"orphanTokens,omitempty"`
+}
+
+// VaultTokenInjectionStatus is the outcome of the last injection
+type VaultTokenInjectionStatus struct {
+	// ObservedGeneration is the generation of the spec the status is for
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Target is the ID of the target the token is injected into
+	Target string `json:"target,omitempty"`
+	// LastInjectionTime is when a token was last injected
+	LastInjectionTime *metav1.Time `json:"lastInjectionTime,omitempty"`
+	// ExpiresAt is when the last injected token expires
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+	// LastError is the error of the last attempt, if it failed
+	LastError string `json:"lastError,omitempty"`
+	// LastErrorTime is when the last attempt failed
+	LastErrorTime *metav1.Time `json:"lastErrorTime,omitempty"`
+}
+
+// Client lists VaultTokenInjection resources and updates their status
+type Client struct {
+	// LabelSelector limits the resources to those with matching labels
+	LabelSelector string
+	// Client is the Kubernetes client. Defaults to kube.NewDynamicClient
+	Client dynamic.Interface
+}
+
+// List returns the resources in a namespace, oldest first
+func (c *Client) List(ctx context.Context, namespace string) ([]VaultTokenInjection, error) {
+	if err := c.setDefaults(); err != nil {
+		return nil, err
+	}
+	list, err := c.Client.Resource(Resource).Namespace(namespace).List(ctx, metav1.ListOptions{LabelSelector: c.LabelSelector})
+	if err != nil {
+		return nil, fmt.Errorf("could not list %s resources in namespace %s: %s", Kind, namespace, err.Error())
+	}
+	injections := make([]VaultTokenInjection, 0, len(list.Items))
+	for _, item := range list.Items {
+		var injection VaultTokenInjection
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, &injection); err != nil {
+			return nil, fmt.Errorf("could not parse %s %s/%s: %s", Kind, item.GetNamespace(), item.GetName(), err.Error())
+		}
+		injections = append(injections, injection)
+	}
+	sort.SliceStable(injections, func(i, j int) bool {
+		return injections[i].CreationTimestamp.Before(&injections[j].CreationTimestamp)
+	})
+	return injections, nil
+}
+
+// UpdateStatus applies fn to the status of a resource and writes it back, retrying
+// if the resource was changed by someone else in the meantime
+func (c *Client) UpdateStatus(ctx context.Context, namespace, name string, fn func(*VaultTokenInjectionStatus)) error {
+	if err := c.setDefaults(); err != nil {
+		return err
+	}
+	resource := c.Client.Resource(Resource).Namespace(namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		obj, err := resource.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		var injection VaultTokenInjection
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &injection); err != nil {
+			return err
+		}
+		fn(&injection.Status)
+		injection.Status.ObservedGeneration = obj.GetGeneration()
+		status, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&injection.Status)
+		if err != nil {
+			return err
+		}
+		if err := unstructured.SetNestedField(obj.Object, status, "status"); err != nil {
+			return err
+		}
+		_, err = resource.UpdateStatus(ctx, obj, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func (c *Client) setDefaults() error {
+	if c.Client == nil {
+		client, err := kube.NewDynamicClient()
+		if err != nil {
+			return fmt.Errorf("could not set up %s client: %s", Kind, err.Error())
+		}
+		c.Client = client
+	}
+	return nil
+}
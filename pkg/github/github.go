@@ -0,0 +1,189 @@
+package github
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+	"k8s.io/klog/v2"
+
+	"github.com/fairwindsops/vault-token-injector/pkg/retry"
+)
+
+// DefaultURL is the public GitHub API
+const DefaultURL = "https://api.github.com"
+
+type Client struct {
+	// Token is a GitHub token that is allowed to manage Actions secrets
+	Token string
+	// URL is the GitHub API URL. Defaults to https://api.github.com
+	URL string
+}
+
+type publicKey struct {
+	KeyID string `json:"key_id"`
+	Key   string `json:"key"`
+}
+
+type secretRequest struct {
+	EncryptedValue string `json:"encrypted_value"`
+	KeyID          string `json:"key_id"`
+	Visibility     string `json:"visibility,omitempty"`
+	// SelectedRepositoryIDs are the repositories that can use an organization secret with selected visibility
+	SelectedRepositoryIDs []int64 `json:"selected_repository_ids,omitempty"`
+}
+
+// SetRepoSecret creates or updates an Actions secret in a repository given as owner/name
+func (c *Client) SetRepoSecret(ctx context.Context, repo, name, value string) error {
+	klog.Infof("setting secret %s in GitHub repository %s", name, repo)
+	return c.setSecret(ctx, fmt.Sprintf("/repos/%s/actions/secrets", repo), name, value, secretRequest{})
+}
+
+// SetEnvironmentSecret creates or updates an Actions secret in a repository environment
+func (c *Client) SetEnvironmentSecret(ctx context.Context, repo, environment, name, value string) error {
+	klog.Infof("setting secret %s in GitHub repository %s environment %s", name, repo, environment)
+	path := fmt.Sprintf("/repos/%s/environments/%s/secrets", repo, url.PathEscape(environment))
+	return c.setSecret(ctx, path, name, value, secretRequest{})
+}
+
+// SetOrgSecret creates or updates an Actions secret in an organization. Visibility
+// is one of all, private or selected, and defaults to private. With selected
+// visibility, only the repositories in selectedRepositoryIDs can use the secret.
+func (c *Client) SetOrgSecret(ctx context.Context, org, name, value, visibility string, selectedRepositoryIDs []int64) error {
+	klog.Infof("setting secret %s in GitHub organization %s", name, org)
+	if visibility == "" {
+		visibility = "private"
+	}
+	return c.setSecret(ctx, fmt.Sprintf("/orgs/%s/actions/secrets", url.PathEscape(org)), name, value, secretRequest{
+		Visibility:            visibility,
+		SelectedRepositoryIDs: selectedRepositoryIDs,
+	})
+}
+
+// CheckRepoSecrets makes sure the repository's secrets public key can be read, without changing anything
+func (c *Client) CheckRepoSecrets(ctx context.Context, repo string) error {
+	_, err := c.getPublicKey(ctx, fmt.Sprintf("/repos/%s/actions/secrets/public-key", repo))
+	return err
+}
+
+// CheckEnvironmentSecrets makes sure the environment's secrets public key can be read, without changing anything
+func (c *Client) CheckEnvironmentSecrets(ctx context.Context, repo, environment string) error {
+	_, err := c.getPublicKey(ctx, fmt.Sprintf("/repos/%s/environments/%s/secrets/public-key", repo, url.PathEscape(environment)))
+	return err
+}
+
+// CheckOrgSecrets makes sure the organization's secrets public key can be read, without changing anything
+func (c *Client) CheckOrgSecrets(ctx context.Context, org string) error {
+	_, err := c.getPublicKey(ctx, fmt.Sprintf("/orgs/%s/actions/secrets/public-key", url.PathEscape(org)))
+	return err
+}
+
+// setSecret encrypts the value with the public key found under basePath and
+// writes it to basePath/name, along with the visibility settings in request
+func (c *Client) setSecret(ctx context.Context, basePath, name, value string, request secretRequest) error {
+	key, err := c.getPublicKey(ctx, basePath+"/public-key")
+	if err != nil {
+		return err
+	}
+	encrypted, err := encrypt(key.Key, value)
+	if err != nil {
+		return err
+	}
+	request.EncryptedValue = encrypted
+	request.KeyID = key.KeyID
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.do(ctx, http.MethodPut, basePath+"/"+url.PathEscape(name), body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusCreated && response.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("failed setting GitHub secret %s. Status Code returned: %d", name, response.StatusCode)
+	}
+	return nil
+}
+
+func (c *Client) getPublicKey(ctx context.Context, path string) (*publicKey, error) {
+	response, err := c.do(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed getting GitHub public key. Status Code returned: %d", response.StatusCode)
+	}
+	key := &publicKey{}
+	if err := json.Unmarshal(response.Body, key); err != nil {
+		return nil, fmt.Errorf("could not parse GitHub public key: %s", err.Error())
+	}
+	return key, nil
+}
+
+type response struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body []byte) (*response, error) {
+	if c.Token == "" {
+		return nil, fmt.Errorf("github client config is incomplete")
+	}
+	baseURL := c.URL
+	if baseURL == "" {
+		baseURL = DefaultURL
+	}
+	request, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(baseURL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Add("Accept", "application/vnd.github+json")
+	request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", c.Token))
+	request.Header.Add("X-GitHub-Api-Version", "2022-11-28")
+	if body != nil {
+		request.Header.Add("Content-Type", "application/json")
+	}
+
+	client := retry.NewClient(time.Second * 10)
+	res, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	klog.V(10).Infof("github response for %s %s: %s", method, path, string(data))
+	return &response{StatusCode: res.StatusCode, Body: data}, nil
+}
+
+// encrypt seals the value with the base64 encoded public key using a libsodium
+// compatible sealed box, as required by the GitHub secrets API
+func encrypt(encodedKey, value string) (string, error) {
+	decodedKey, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return "", fmt.Errorf("could not decode GitHub public key: %s", err.Error())
+	}
+	if len(decodedKey) != 32 {
+		return "", fmt.Errorf("GitHub public key has unexpected length %d", len(decodedKey))
+	}
+	var key [32]byte
+	copy(key[:], decodedKey)
+
+	sealed, err := box.SealAnonymous(nil, []byte(value), &key, rand.Reader)
+	if err != nil {
+		return "", fmt.Errorf("could not encrypt secret: %s", err.Error())
+	}
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
@@ -0,0 +1,125 @@
+package github
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// fakeGitHub records each secret written to it by path, decrypted
+type fakeGitHub struct {
+	publicKey  *[32]byte
+	privateKey *[32]byte
+	secrets    map[string]string
+	visibility map[string]string
+	selected   map[string][]int64
+}
+
+func (f *fakeGitHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer gh-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method == http.MethodGet {
+		switch r.URL.Path {
+		case "/repos/org/repo/actions/secrets/public-key",
+			"/repos/org/repo/environments/prod env/secrets/public-key",
+			"/orgs/org/actions/secrets/public-key":
+			_ = json.NewEncoder(w).Encode(publicKey{
+				KeyID: "key-1",
+				Key:   base64.StdEncoding.EncodeToString(f.publicKey[:]),
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+		return
+	}
+
+	request := secretRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.KeyID != "key-1" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	sealed, _ := base64.StdEncoding.DecodeString(request.EncryptedValue)
+	value, ok := box.OpenAnonymous(nil, sealed, f.publicKey, f.privateKey)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.secrets[r.URL.Path] = string(value)
+	f.visibility[r.URL.Path] = request.Visibility
+	f.selected[r.URL.Path] = request.SelectedRepositoryIDs
+	w.WriteHeader(http.StatusCreated)
+}
+
+func TestSetSecrets(t *testing.T) {
+	publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	fake := &fakeGitHub{
+		publicKey:  publicKey,
+		privateKey: privateKey,
+		secrets:    map[string]string{},
+		visibility: map[string]string{},
+		selected:   map[string][]int64{},
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := &Client{Token: "gh-token", URL: server.URL}
+
+	assert.NoError(t, client.SetRepoSecret(context.Background(), "org/repo", "VAULT_TOKEN", "hvs.repo"))
+	assert.NoError(t, client.SetEnvironmentSecret(context.Background(), "org/repo", "prod env", "VAULT_TOKEN", "hvs.env"))
+	assert.NoError(t, client.SetOrgSecret(context.Background(), "org", "VAULT_TOKEN", "hvs.org", "", nil))
+	assert.NoError(t, client.SetOrgSecret(context.Background(), "org", "VAULT_ADDR", "https://vault", "selected", []int64{1, 2}))
+
+	assert.EqualValues(t, map[string]string{
+		"/repos/org/repo/actions/secrets/VAULT_TOKEN":               "hvs.repo",
+		"/repos/org/repo/environments/prod env/secrets/VAULT_TOKEN": "hvs.env",
+		"/orgs/org/actions/secrets/VAULT_TOKEN":                     "hvs.org",
+		"/orgs/org/actions/secrets/VAULT_ADDR":                      "https://vault",
+	}, fake.secrets)
+	assert.Equal(t, "private", fake.visibility["/orgs/org/actions/secrets/VAULT_TOKEN"])
+	assert.Empty(t, fake.selected["/orgs/org/actions/secrets/VAULT_TOKEN"])
+	assert.Equal(t, "selected", fake.visibility["/orgs/org/actions/secrets/VAULT_ADDR"])
+	assert.Equal(t, []int64{1, 2}, fake.selected["/orgs/org/actions/secrets/VAULT_ADDR"])
+}
+
+func TestSetSecretErrors(t *testing.T) {
+	// Every case fails before a secret is written
+	publicKey, _, err := box.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	server := httptest.NewServer(&fakeGitHub{publicKey: publicKey})
+	defer server.Close()
+	tests := []struct {
+		name   string
+		client *Client
+		repo   string
+	}{
+		{
+			name:   "no token",
+			client: &Client{URL: server.URL},
+			repo:   "org/repo",
+		},
+		{
+			name:   "bad token",
+			client: &Client{Token: "nope", URL: server.URL},
+			repo:   "org/repo",
+		},
+		{
+			name:   "missing repository",
+			client: &Client{Token: "gh-token", URL: server.URL},
+			repo:   "org/missing",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Error(t, tt.client.SetRepoSecret(context.Background(), tt.repo, "VAULT_TOKEN", "hvs.repo"))
+		})
+	}
+}
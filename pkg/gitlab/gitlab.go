@@ -0,0 +1,126 @@
+package gitlab
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/fairwindsops/vault-token-injector/pkg/retry"
+)
+
+// DefaultURL is the public GitLab instance
+const DefaultURL = "https://gitlab.com"
+
+type Client struct {
+	// Token is a GitLab access token with the api scope
+	Token string
+	// URL is the base URL of the GitLab instance. Defaults to https://gitlab.com
+	URL string
+}
+
+// Variable is a GitLab CI/CD variable
+type Variable struct {
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	Masked    bool   `json:"masked"`
+	Protected bool   `json:"protected"`
+}
+
+// SetProjectVariable creates or updates a CI/CD variable in a project. The project
+// can be a numeric ID or the full path, e.g. group/project
+func (c *Client) SetProjectVariable(ctx context.Context, project string, variable Variable) error {
+	klog.Infof("setting variable %s in GitLab project %s", variable.Key, project)
+	return c.setVariable(ctx, fmt.Sprintf("/projects/%s/variables", url.PathEscape(project)), variable)
+}
+
+// SetGroupVariable creates or updates a CI/CD variable in a group. The group can
+// be a numeric ID or the full path
+func (c *Client) SetGroupVariable(ctx context.Context, group string, variable Variable) error {
+	klog.Infof("setting variable %s in GitLab group %s", variable.Key, group)
+	return c.setVariable(ctx, fmt.Sprintf("/groups/%s/variables", url.PathEscape(group)), variable)
+}
+
+// CheckProject makes sure the project exists and its variables can be listed, without changing anything
+func (c *Client) CheckProject(ctx context.Context, project string) error {
+	return c.check(ctx, fmt.Sprintf("/projects/%s/variables", url.PathEscape(project)), "project "+project)
+}
+
+// CheckGroup makes sure the group exists and its variables can be listed, without changing anything
+func (c *Client) CheckGroup(ctx context.Context, group string) error {
+	return c.check(ctx, fmt.Sprintf("/groups/%s/variables", url.PathEscape(group)), "group "+group)
+}
+
+func (c *Client) check(ctx context.Context, path, description string) error {
+	statusCode, err := c.do(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	if statusCode != http.StatusOK {
+		return fmt.Errorf("failed reading variables of GitLab %s. Status Code returned: %d", description, statusCode)
+	}
+	return nil
+}
+
+// setVariable updates the variable, creating it if it does not exist yet
+func (c *Client) setVariable(ctx context.Context, basePath string, variable Variable) error {
+	body, err := json.Marshal(variable)
+	if err != nil {
+		return err
+	}
+
+	statusCode, err := c.do(ctx, http.MethodPut, basePath+"/"+url.PathEscape(variable.Key), body)
+	if err != nil {
+		return err
+	}
+	switch statusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		klog.V(3).Infof("variable %s does not exist in GitLab, creating it", variable.Key)
+	default:
+		return fmt.Errorf("failed updating GitLab variable %s. Status Code returned: %d", variable.Key, statusCode)
+	}
+
+	statusCode, err = c.do(ctx, http.MethodPost, basePath, body)
+	if err != nil {
+		return err
+	}
+	if statusCode != http.StatusCreated {
+		return fmt.Errorf("failed creating GitLab variable %s. Status Code returned: %d", variable.Key, statusCode)
+	}
+	return nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body []byte) (int, error) {
+	if c.Token == "" {
+		return 0, fmt.Errorf("gitlab client config is incomplete")
+	}
+	baseURL := c.URL
+	if baseURL == "" {
+		baseURL = DefaultURL
+	}
+	request, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(baseURL, "/")+"/api/v4"+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Add("PRIVATE-TOKEN", c.Token)
+	request.Header.Add("Content-Type", "application/json")
+
+	client := retry.NewClient(time.Second * 10)
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	data, _ := io.ReadAll(response.Body)
+	klog.V(10).Infof("gitlab response for %s %s: %s", method, path, string(data))
+	return response.StatusCode, nil
+}
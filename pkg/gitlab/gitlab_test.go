@@ -0,0 +1,147 @@
+package gitlab
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeGitLab keeps variables by their escaped API path and records requests
+type fakeGitLab struct {
+	variables map[string]map[string]Variable
+	requests  []string
+}
+
+func serveGitLab(t *testing.T, paths ...string) (*fakeGitLab, string) {
+	fake := &fakeGitLab{variables: map[string]map[string]Variable{}}
+	for _, path := range paths {
+		fake.variables[path] = map[string]Variable{}
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server.URL
+}
+
+func (f *fakeGitLab) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.EscapedPath()
+	f.requests = append(f.requests, r.Method+" "+path)
+	if r.Header.Get("PRIVATE-TOKEN") != "gl-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	basePath, key := path, ""
+	if i := strings.LastIndex(path, "/variables/"); i >= 0 {
+		basePath, key = path[:i+len("/variables")], path[i+len("/variables/"):]
+	}
+	variables, ok := f.variables[basePath]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var variable Variable
+	if r.Method != http.MethodGet {
+		if err := json.NewDecoder(r.Body).Decode(&variable); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPut && key != "":
+		if _, ok := variables[key]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		variables[key] = variable
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPost && key == "":
+		if _, ok := variables[variable.Key]; ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		variables[variable.Key] = variable
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestSetProjectVariable(t *testing.T) {
+	fake, url := serveGitLab(t, "/api/v4/projects/group%2Fapp/variables")
+	client := &Client{Token: "gl-token", URL: url + "/"}
+	token := Variable{Key: "VAULT_TOKEN", Value: "hvs.1", Masked: true, Protected: true}
+
+	// The first write creates the variable, later writes update it
+	assert.NoError(t, client.SetProjectVariable(context.Background(), "group/app", token))
+	token.Value = "hvs.2"
+	assert.NoError(t, client.SetProjectVariable(context.Background(), "group/app", token))
+
+	assert.Equal(t, map[string]Variable{
+		"VAULT_TOKEN": {Key: "VAULT_TOKEN", Value: "hvs.2", Masked: true, Protected: true},
+	}, fake.variables["/api/v4/projects/group%2Fapp/variables"])
+	assert.Equal(t, []string{
+		"PUT /api/v4/projects/group%2Fapp/variables/VAULT_TOKEN",
+		"POST /api/v4/projects/group%2Fapp/variables",
+		"PUT /api/v4/projects/group%2Fapp/variables/VAULT_TOKEN",
+	}, fake.requests)
+}
+
+func TestSetGroupVariable(t *testing.T) {
+	fake, url := serveGitLab(t, "/api/v4/groups/group%2Fsub/variables")
+	client := &Client{Token: "gl-token", URL: url}
+
+	assert.NoError(t, client.SetGroupVariable(context.Background(), "group/sub", Variable{Key: "VAULT_ADDR", Value: "https://vault"}))
+	assert.Equal(t, map[string]Variable{
+		"VAULT_ADDR": {Key: "VAULT_ADDR", Value: "https://vault"},
+	}, fake.variables["/api/v4/groups/group%2Fsub/variables"])
+}
+
+func TestSetVariableErrors(t *testing.T) {
+	_, url := serveGitLab(t, "/api/v4/projects/group%2Fapp/variables")
+	tests := []struct {
+		name    string
+		client  *Client
+		project string
+		wantErr string
+	}{
+		{
+			name:    "no token",
+			client:  &Client{URL: url},
+			project: "group/app",
+			wantErr: "gitlab client config is incomplete",
+		},
+		{
+			name:    "bad token",
+			client:  &Client{Token: "nope", URL: url},
+			project: "group/app",
+			wantErr: "failed updating GitLab variable VAULT_TOKEN. Status Code returned: 401",
+		},
+		{
+			name:    "missing project",
+			client:  &Client{Token: "gl-token", URL: url},
+			project: "group/missing",
+			wantErr: "failed creating GitLab variable VAULT_TOKEN. Status Code returned: 404",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.client.SetProjectVariable(context.Background(), tt.project, Variable{Key: "VAULT_TOKEN", Value: "hvs.1"})
+			assert.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	_, url := serveGitLab(t, "/api/v4/projects/group%2Fapp/variables", "/api/v4/groups/group%2Fsub/variables")
+	client := &Client{Token: "gl-token", URL: url}
+	assert.NoError(t, client.CheckProject(context.Background(), "group/app"))
+	assert.NoError(t, client.CheckGroup(context.Background(), "group/sub"))
+	assert.EqualError(t, client.CheckProject(context.Background(), "group/missing"), "failed reading variables of GitLab project group/missing. Status Code returned: 404")
+}
@@ -0,0 +1,65 @@
+package kube
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// namespaceFile holds the namespace of the pod's service account
+const namespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// NewClient returns a client for the cluster
+func NewClient() (kubernetes.Interface, error) {
+	config, err := restConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("could not create kubernetes client: %s", err.Error())
+	}
+	return client, nil
+}
+
+// NewDynamicClient returns a client for custom resources in the cluster
+func NewDynamicClient() (dynamic.Interface, error) {
+	config, err := restConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("could not create kubernetes client: %s", err.Error())
+	}
+	return client, nil
+}
+
+// restConfig loads the config used by every client. It is the in-cluster config,
+// or the KUBECONFIG env var when set.
+func restConfig() (*rest.Config, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", os.Getenv("KUBECONFIG"))
+	if err != nil {
+		return nil, fmt.Errorf("could not load kubernetes config: %s", err.Error())
+	}
+	return config, nil
+}
+
+// Namespace returns the namespace from the POD_NAMESPACE env var or the service
+// account, falling back to default
+func Namespace() string {
+	if namespace := os.Getenv("POD_NAMESPACE"); namespace != "" {
+		return namespace
+	}
+	if data, err := os.ReadFile(namespaceFile); err == nil {
+		if namespace := strings.TrimSpace(string(data)); namespace != "" {
+			return namespace
+		}
+	}
+	return "default"
+}
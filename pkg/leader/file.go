@@ -0,0 +1,60 @@
+package leader
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// FileElector elects a leader by taking an exclusive lock on a file. It is meant
+// for replicas that share a host or a filesystem that supports locking, outside
+// of Kubernetes. The lock is released by the operating system if the process
+// dies, so a follower takes over within one retry period.
+type FileElector struct {
+	// Path is the file to lock. It is created if it does not exist
+	Path string
+	// RetryPeriod is how often a follower tries to take the lock. Defaults to 2 seconds
+	RetryPeriod time.Duration
+}
+
+// Run waits for the lock and runs lead until ctx is done
+func (e *FileElector) Run(ctx context.Context, lead func(ctx context.Context)) error {
+	if e.Path == "" {
+		return fmt.Errorf("file leader election requires a lock file")
+	}
+	retryPeriod := e.RetryPeriod
+	if retryPeriod == 0 {
+		retryPeriod = time.Second * 2
+	}
+	file, err := os.OpenFile(e.Path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return fmt.Errorf("could not open leader lock file: %s", err.Error())
+	}
+	defer file.Close()
+
+	klog.Infof("waiting to acquire leader lock %s", e.Path)
+	for {
+		acquired, err := tryLock(file)
+		if err != nil {
+			return fmt.Errorf("could not lock leader lock file: %s", err.Error())
+		}
+		if acquired {
+			break
+		}
+		timer := time.NewTimer(retryPeriod)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+	defer unlock(file)
+
+	klog.Infof("acquired leader lock %s, starting as the leader", e.Path)
+	lead(ctx)
+	return nil
+}
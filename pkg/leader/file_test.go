@@ -0,0 +1,55 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package leader
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileElector(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leader.lock")
+	newElector := func() *FileElector {
+		return &FileElector{Path: path, RetryPeriod: time.Millisecond * 50}
+	}
+
+	ctxA, stopA := context.WithCancel(context.Background())
+	leadingA := make(chan struct{})
+	doneA := make(chan error)
+	go func() {
+		doneA <- newElector().Run(ctxA, func(ctx context.Context) {
+			close(leadingA)
+			<-ctx.Done()
+		})
+	}()
+	<-leadingA
+
+	ctxB, stopB := context.WithCancel(context.Background())
+	leadingB := make(chan struct{})
+	doneB := make(chan error)
+	go func() {
+		doneB <- newElector().Run(ctxB, func(ctx context.Context) {
+			close(leadingB)
+			<-ctx.Done()
+		})
+	}()
+	select {
+	case <-leadingB:
+		t.Fatal("b became the leader while a held the lock")
+	case <-time.After(time.Millisecond * 200):
+	}
+
+	stopA()
+	assert.NoError(t, <-doneA)
+	select {
+	case <-leadingB:
+	case <-time.After(time.Second):
+		t.Fatal("b did not take over after a released the lock")
+	}
+	stopB()
+	assert.NoError(t, <-doneB)
+}
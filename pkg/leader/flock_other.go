@@ -0,0 +1,17 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package leader
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+func tryLock(file *os.File) (bool, error) {
+	return false, fmt.Errorf("file locking is not supported on %s", runtime.GOOS)
+}
+
+func unlock(file *os.File) error {
+	return nil
+}
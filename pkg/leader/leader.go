@@ -0,0 +1,37 @@
+package leader
+
+import (
+	"context"
+	"errors"
+	"os"
+)
+
+// DefaultName is the default name of the Lease used for leader election
+const DefaultName = "vault-token-injector"
+
+// ErrLostLeadership is the cause of the context passed to lead being cancelled
+// when leadership is lost, rather than because ctx is done. Another replica may
+// take over at any moment, so work should stop straight away.
+var ErrLostLeadership = errors.New("lost leadership")
+
+// Elector makes sure that only one replica at a time does work
+type Elector interface {
+	// Run waits until this replica is the leader and then calls lead with a
+	// context that is cancelled when leadership is lost or ctx is done. When
+	// leadership is lost, context.Cause of that context is ErrLostLeadership.
+	// Run returns once ctx is done and lead has returned.
+	Run(ctx context.Context, lead func(ctx context.Context)) error
+}
+
+// Identity returns a name for this replica. It is the POD_NAME env var when set,
+// falling back to the hostname, which is the pod name in Kubernetes.
+func Identity() string {
+	if name := os.Getenv("POD_NAME"); name != "" {
+		return name
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "vault-token-injector"
+	}
+	return hostname
+}
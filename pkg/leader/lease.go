@@ -0,0 +1,141 @@
+package leader
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+
+	"github.com/fairwindsops/vault-token-injector/pkg/kube"
+)
+
+// LeaseElector elects a leader using a Kubernetes Lease
+type LeaseElector struct {
+	// Name is the name of the Lease. Defaults to DefaultName
+	Name string
+	// Namespace is the namespace of the Lease. Defaults to the namespace the pod is running in
+	Namespace string
+	// Identity is the name this replica holds the Lease under. Defaults to Identity()
+	Identity string
+	// LeaseDuration is how long followers wait before taking over an expired Lease. Defaults to 15 seconds
+	LeaseDuration time.Duration
+	// RenewDeadline is how long the leader keeps trying to renew the Lease before giving up leadership. Defaults to 10 seconds
+	RenewDeadline time.Duration
+	// RetryPeriod is how often the Lease is renewed or tried. Defaults to 2 seconds
+	RetryPeriod time.Duration
+	// Client is the Kubernetes client. Defaults to kube.NewClient
+	Client kubernetes.Interface
+}
+
+// Run campaigns for the Lease until ctx is done. Leadership is given up when the
+// Lease can not be renewed, after which this replica campaigns again. The Lease
+// is released on shutdown, once lead has returned, so that another replica can
+// take over straight away.
+func (e *LeaseElector) Run(ctx context.Context, lead func(ctx context.Context)) error {
+	if err := e.setDefaults(); err != nil {
+		return err
+	}
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      e.Name,
+			Namespace: e.Namespace,
+		},
+		Client: e.Client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: e.Identity,
+		},
+	}
+	klog.Infof("waiting to acquire lease %s/%s as %s", e.Namespace, e.Name, e.Identity)
+	for ctx.Err() == nil {
+		if err := e.campaign(ctx, lock, lead); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// campaign waits to acquire the Lease and runs lead for as long as it is held
+func (e *LeaseElector) campaign(ctx context.Context, lock resourcelock.Interface, lead func(ctx context.Context)) error {
+	// The election outlives ctx so that the Lease is kept until lead has returned
+	electionCtx, cancelElection := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelElection()
+
+	started := make(chan context.Context, 1)
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		Name:            e.Name,
+		LeaseDuration:   e.LeaseDuration,
+		RenewDeadline:   e.RenewDeadline,
+		RetryPeriod:     e.RetryPeriod,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(leaderCtx context.Context) {
+				started <- leaderCtx
+			},
+			OnStoppedLeading: func() {
+				klog.Infof("no longer the leader for lease %s/%s", e.Namespace, e.Name)
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("invalid leader election config: %s", err.Error())
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		elector.Run(electionCtx)
+	}()
+
+	select {
+	case leaderCtx := <-started:
+		klog.Infof("acquired lease %s/%s, starting as the leader", e.Namespace, e.Name)
+		// leaderCtx is only cancelled while lead is running if the Lease could not
+		// be renewed, as the election outlives ctx
+		leadCtx, cancelLead := context.WithCancelCause(context.WithoutCancel(ctx))
+		stop := context.AfterFunc(ctx, func() { cancelLead(context.Canceled) })
+		stopLost := context.AfterFunc(leaderCtx, func() { cancelLead(ErrLostLeadership) })
+		lead(leadCtx)
+		stop()
+		stopLost()
+		cancelLead(nil)
+	case <-done:
+	case <-ctx.Done():
+	}
+	cancelElection()
+	<-done
+	return nil
+}
+
+func (e *LeaseElector) setDefaults() error {
+	if e.Name == "" {
+		e.Name = DefaultName
+	}
+	if e.Namespace == "" {
+		e.Namespace = kube.Namespace()
+	}
+	if e.Identity == "" {
+		e.Identity = Identity()
+	}
+	if e.LeaseDuration == 0 {
+		e.LeaseDuration = time.Second * 15
+	}
+	if e.RenewDeadline == 0 {
+		e.RenewDeadline = time.Second * 10
+	}
+	if e.RetryPeriod == 0 {
+		e.RetryPeriod = time.Second * 2
+	}
+	if e.Client == nil {
+		client, err := kube.NewClient()
+		if err != nil {
+			return fmt.Errorf("could not set up leader election: %s", err.Error())
+		}
+		e.Client = client
+	}
+	return nil
+}
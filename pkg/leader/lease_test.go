@@ -0,0 +1,119 @@
+package leader
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestLeaseElector(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	newElector := func(identity string) *LeaseElector {
+		return &LeaseElector{
+			Namespace:     "default",
+			Identity:      identity,
+			LeaseDuration: time.Second * 2,
+			RenewDeadline: time.Second,
+			RetryPeriod:   time.Millisecond * 100,
+			Client:        client,
+		}
+	}
+
+	ctxA, stopA := context.WithCancel(context.Background())
+	leadingA := make(chan struct{})
+	doneA := make(chan error)
+	go func() {
+		doneA <- newElector("a").Run(ctxA, func(ctx context.Context) {
+			close(leadingA)
+			<-ctx.Done()
+		})
+	}()
+	select {
+	case <-leadingA:
+	case <-time.After(time.Second * 5):
+		t.Fatal("a never became the leader")
+	}
+
+	ctxB, stopB := context.WithCancel(context.Background())
+	defer stopB()
+	leadingB := make(chan struct{})
+	doneB := make(chan error)
+	go func() {
+		doneB <- newElector("b").Run(ctxB, func(ctx context.Context) {
+			close(leadingB)
+			<-ctx.Done()
+		})
+	}()
+	select {
+	case <-leadingB:
+		t.Fatal("b became the leader while a held the lease")
+	case <-time.After(time.Millisecond * 500):
+	}
+
+	// Shutting down a releases the lease, so b takes over without waiting for it to expire
+	stopA()
+	assert.NoError(t, <-doneA)
+	select {
+	case <-leadingB:
+	case <-time.After(time.Second):
+		t.Fatal("b did not take over after a released the lease")
+	}
+	lease, err := client.CoordinationV1().Leases("default").Get(context.Background(), DefaultName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "b", *lease.Spec.HolderIdentity)
+
+	stopB()
+	assert.NoError(t, <-doneB)
+}
+
+func TestLeaseElectorLostLeadership(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	var unreachable atomic.Bool
+	client.PrependReactor("update", "leases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if unreachable.Load() {
+			return true, nil, errors.New("unreachable")
+		}
+		return false, nil, nil
+	})
+	elector := &LeaseElector{
+		Namespace:     "default",
+		Identity:      "a",
+		LeaseDuration: time.Second * 2,
+		RenewDeadline: time.Second,
+		RetryPeriod:   time.Millisecond * 100,
+		Client:        client,
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	leading := make(chan struct{}, 1)
+	causes := make(chan error, 1)
+	go elector.Run(ctx, func(ctx context.Context) {
+		leading <- struct{}{}
+		<-ctx.Done()
+		causes <- context.Cause(ctx)
+	})
+	select {
+	case <-leading:
+	case <-time.After(time.Second * 5):
+		t.Fatal("a never became the leader")
+	}
+
+	// The Lease can no longer be renewed, as if the API server were unreachable
+	unreachable.Store(true)
+
+	select {
+	case cause := <-causes:
+		assert.ErrorIs(t, cause, ErrLostLeadership)
+	case <-time.After(time.Second * 5):
+		t.Fatal("a kept leading after losing the lease")
+	}
+}
@@ -0,0 +1,294 @@
+package retry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// Policy describes how many times, and how often, a failed call is retried
+type Policy struct {
+	// MaxAttempts is the total number of attempts, including the first one
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry. It doubles after each attempt
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between attempts, including waits requested by the server
+	MaxBackoff time.Duration
+	// Jitter is the largest fraction of each wait that is randomly added to it
+	Jitter float64
+}
+
+// builtinPolicy is the default policy until SetDefaultPolicy is called
+var builtinPolicy = Policy{
+	MaxAttempts:    4,
+	InitialBackoff: time.Second,
+	MaxBackoff:     time.Minute,
+	Jitter:         0.2,
+}
+
+var (
+	defaultPolicy = builtinPolicy
+	defaultLock   sync.RWMutex
+)
+
+// DefaultPolicy returns the policy used by Do and Transport when none is given
+func DefaultPolicy() Policy {
+	defaultLock.RLock()
+	defer defaultLock.RUnlock()
+	return defaultPolicy
+}
+
+// BuiltinPolicy returns the default policy used when SetDefaultPolicy has not been called
+func BuiltinPolicy() Policy {
+	return builtinPolicy
+}
+
+// SetDefaultPolicy replaces the default policy. MaxAttempts, InitialBackoff and
+// MaxBackoff fall back to their built-in defaults when not set, rather than
+// keeping their current value. Jitter is used as given, so zero disables it.
+func SetDefaultPolicy(p Policy) {
+	defaultLock.Lock()
+	defer defaultLock.Unlock()
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = builtinPolicy.MaxAttempts
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = builtinPolicy.InitialBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = builtinPolicy.MaxBackoff
+	}
+	if p.Jitter < 0 {
+		p.Jitter = 0
+	}
+	defaultPolicy = p
+}
+
+// Error marks an error as retryable. If After is set, the next attempt waits
+// that long instead of the computed backoff.
+type Error struct {
+	Err   error
+	After time.Duration
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Retryable marks an error as retryable
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Err: err}
+}
+
+// Do calls fn until it succeeds, returns an error that is not retryable, or the
+// policy runs out of attempts. The last error is returned.
+func (p Policy) Do(fn func() error) error {
+	return p.DoContext(context.Background(), fn)
+}
+
+// DoContext is like Do, but stops waiting to retry when the context is done
+func (p Policy) DoContext(ctx context.Context, fn func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		var retryErr *Error
+		if err == nil || !errors.As(err, &retryErr) {
+			return err
+		}
+		if attempt >= p.MaxAttempts {
+			return retryErr.Err
+		}
+		wait := p.wait(attempt, retryErr.After)
+		klog.V(3).Infof("attempt %d of %d failed, retrying in %s: %s", attempt, p.MaxAttempts, wait.String(), err.Error())
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return retryErr.Err
+		case <-timer.C:
+		}
+	}
+}
+
+// wait returns how long to wait after the given attempt. A wait requested by the
+// server is used in place of the exponential backoff.
+func (p Policy) wait(attempt int, after time.Duration) time.Duration {
+	wait := after
+	if wait <= 0 {
+		wait = p.InitialBackoff << (attempt - 1)
+	}
+	if p.MaxBackoff > 0 && (wait > p.MaxBackoff || wait <= 0) {
+		wait = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		wait += time.Duration(float64(wait) * p.Jitter * rand.Float64())
+	}
+	return wait
+}
+
+// Transport is an http.RoundTripper that retries requests that fail with a network
+// error, a 429, or a 5xx, honoring the Retry-After and RateLimit-Reset headers.
+// Requests that are not idempotent, such as a POST, are only retried after a 429,
+// or a 503 with a Retry-After header, where the server did not act on them.
+type Transport struct {
+	// Base is the transport used to make requests. Defaults to http.DefaultTransport
+	Base http.RoundTripper
+	// Policy is the retry policy. Defaults to the default policy at the time of each request
+	Policy *Policy
+	// Timeout limits each attempt, including reading the response body. Zero means no limit.
+	// Use this rather than http.Client.Timeout, which would also cover the waits between attempts.
+	Timeout time.Duration
+}
+
+// NewClient returns an http.Client that retries with the default policy, with each
+// attempt limited to the given timeout
+func NewClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: &Transport{Timeout: timeout},
+	}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	policy := DefaultPolicy()
+	if t.Policy != nil {
+		policy = *t.Policy
+	}
+
+	// Buffer the body so that it can be sent again
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var response *http.Response
+	err := policy.DoContext(req.Context(), func() error {
+		if response != nil {
+			response.Body.Close()
+		}
+		ctx, cancel := req.Context(), context.CancelFunc(func() {})
+		if t.Timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, t.Timeout)
+		}
+		attempt := req.Clone(ctx)
+		if body != nil {
+			attempt.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		var err error
+		response, err = base.RoundTrip(attempt)
+		if err != nil {
+			cancel()
+			if req.Context().Err() != nil || !idempotent(req) {
+				return err
+			}
+			return Retryable(err)
+		}
+		response.Body = &cancelBody{ReadCloser: response.Body, cancel: cancel}
+		if !retryableResponse(req, response) {
+			return nil
+		}
+		after := RetryAfter(response)
+		err = fmt.Errorf("%s %s returned %d", req.Method, req.URL.Redacted(), response.StatusCode)
+		if response.StatusCode == http.StatusTooManyRequests {
+			klog.Warningf("rate limit encountered on %s, retry after %s", req.URL.Host, after.String())
+		}
+		return &Error{Err: err, After: after}
+	})
+	if response != nil {
+		// The last response is returned as-is so the caller can handle the status code
+		return response, nil
+	}
+	return nil, err
+}
+
+// cancelBody cancels the context of an attempt once its response body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// retryableResponse returns true if the request can be sent again after getting
+// the response. A request that is not idempotent may already have been acted on
+// after a 5xx, unless the server asked for it to be retried later.
+func retryableResponse(req *http.Request, response *http.Response) bool {
+	switch {
+	case response.StatusCode == http.StatusTooManyRequests:
+		return true
+	case response.StatusCode == http.StatusServiceUnavailable && response.Header.Get("Retry-After") != "":
+		return true
+	case response.StatusCode >= http.StatusInternalServerError:
+		return idempotent(req)
+	}
+	return false
+}
+
+// idempotent returns true if sending the request more than once has the same
+// effect as sending it once
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// RetryAfter returns how long the server asked the client to wait before retrying,
+// from the Retry-After, RateLimit-Reset, or X-RateLimit-Reset headers. The reset
+// headers can be either a number of seconds or a unix timestamp. It returns zero
+// if no wait was requested.
+func RetryAfter(response *http.Response) time.Duration {
+	if value := response.Header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil {
+			return time.Duration(seconds) * time.Second
+		}
+		if date, err := http.ParseTime(value); err == nil {
+			return time.Until(date)
+		}
+	}
+	for _, header := range []string{"RateLimit-Reset", "X-RateLimit-Reset"} {
+		value := response.Header.Get(header)
+		if value == "" {
+			continue
+		}
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		// Anything this large is a unix timestamp rather than a number of seconds
+		if seconds > 1_000_000_000 {
+			return time.Until(time.Unix(seconds, 0))
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	return 0
+}
@@ -0,0 +1,159 @@
+package retry
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    time.Duration
+	}{
+		{
+			name: "none",
+			want: 0,
+		},
+		{
+			name:    "retry after seconds",
+			headers: map[string]string{"Retry-After": "7"},
+			want:    time.Second * 7,
+		},
+		{
+			name:    "ratelimit reset seconds",
+			headers: map[string]string{"RateLimit-Reset": "3"},
+			want:    time.Second * 3,
+		},
+		{
+			name:    "retry after takes precedence",
+			headers: map[string]string{"Retry-After": "1", "X-RateLimit-Reset": "30"},
+			want:    time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := &http.Response{Header: http.Header{}}
+			for k, v := range tt.headers {
+				response.Header.Set(k, v)
+			}
+			assert.Equal(t, tt.want, RetryAfter(response))
+		})
+	}
+
+	response := &http.Response{Header: http.Header{}}
+	response.Header.Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10))
+	assert.InDelta(t, time.Minute, RetryAfter(response), float64(time.Second*2))
+}
+
+func TestSetDefaultPolicy(t *testing.T) {
+	t.Cleanup(func() { SetDefaultPolicy(Policy{}) })
+
+	SetDefaultPolicy(Policy{MaxAttempts: 2, MaxBackoff: time.Second * 10, Jitter: 0.5})
+	assert.Equal(t, Policy{MaxAttempts: 2, InitialBackoff: time.Second, MaxBackoff: time.Second * 10, Jitter: 0.5}, DefaultPolicy())
+
+	// Fields that are no longer set go back to their defaults, and zero jitter disables it
+	SetDefaultPolicy(Policy{MaxAttempts: 5})
+	assert.Equal(t, Policy{MaxAttempts: 5, InitialBackoff: time.Second, MaxBackoff: time.Minute}, DefaultPolicy())
+
+	SetDefaultPolicy(BuiltinPolicy())
+	assert.Equal(t, BuiltinPolicy(), DefaultPolicy())
+}
+
+func TestDo(t *testing.T) {
+	policy := Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+
+	attempts := 0
+	err := policy.Do(func() error {
+		attempts++
+		return Retryable(errors.New("transient"))
+	})
+	assert.EqualError(t, err, "transient")
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	err = policy.Do(func() error {
+		attempts++
+		return errors.New("permanent")
+	})
+	assert.EqualError(t, err, "permanent")
+	assert.Equal(t, 1, attempts)
+}
+
+func TestTransport(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, "payload", string(body))
+		if attempts < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &Transport{Policy: &Policy{MaxAttempts: 5, InitialBackoff: time.Millisecond}}}
+	response, err := client.Post(server.URL, "text/plain", strings.NewReader("payload"))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	client = &http.Client{Transport: &Transport{Policy: &Policy{MaxAttempts: 2, InitialBackoff: time.Millisecond}}}
+	response, err = client.Post(server.URL, "text/plain", strings.NewReader("payload"))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, response.StatusCode)
+	assert.Equal(t, 2, attempts)
+}
+
+func TestTransportNotIdempotent(t *testing.T) {
+	attempts := 0
+	status := http.StatusBadGateway
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			if status == http.StatusServiceUnavailable {
+				w.Header().Set("Retry-After", "0")
+			}
+			w.WriteHeader(status)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: &Transport{Policy: &Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond}}}
+
+	// A POST that failed with a 5xx may have been acted on, so it is not sent again
+	response, err := client.Post(server.URL, "text/plain", strings.NewReader("payload"))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, response.StatusCode)
+	assert.Equal(t, 1, attempts)
+
+	// A PUT can be sent again
+	attempts = 0
+	request, err := http.NewRequest(http.MethodPut, server.URL, strings.NewReader("payload"))
+	assert.NoError(t, err)
+	response, err = client.Do(request)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, 2, attempts)
+
+	// A 503 with a Retry-After header means the POST was not acted on
+	attempts = 0
+	status = http.StatusServiceUnavailable
+	response, err = client.Post(server.URL, "text/plain", strings.NewReader("payload"))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, 2, attempts)
+}
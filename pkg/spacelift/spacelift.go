@@ -2,14 +2,18 @@ package spacelift
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"slices"
 	"strings"
 	"time"
 
 	"k8s.io/klog/v2"
+
+	"github.com/fairwindsops/vault-token-injector/pkg/retry"
 )
 
 type Client struct {
@@ -29,7 +33,19 @@ type EnvVar struct {
 	WriteOnly bool
 }
 
-func (c *Client) SetEnvVars(stack string, vars []EnvVar) error {
+// SetEnvVars sets the env vars in a stack
+func (c *Client) SetEnvVars(ctx context.Context, stack string, vars []EnvVar) error {
+	return c.addConfig(ctx, "stackConfigAdd", "stack", stack, vars)
+}
+
+// SetContextEnvVars sets the env vars in a context, so that every stack the context
+// is attached to inherits them
+func (c *Client) SetContextEnvVars(ctx context.Context, contextID string, vars []EnvVar) error {
+	return c.addConfig(ctx, "contextConfigAdd", "context", contextID, vars)
+}
+
+// addConfig runs the given config mutation for each env var against the stack or context with the given ID
+func (c *Client) addConfig(ctx context.Context, mutation, argument, id string, vars []EnvVar) error {
 	if c.URL == "" || c.APIKeyID == "" || c.APIKeySecret == "" || c.jwt == "" {
 		return fmt.Errorf("spacelift client config is incomplete")
 	}
@@ -37,8 +53,8 @@ func (c *Client) SetEnvVars(stack string, vars []EnvVar) error {
 	for _, envVar := range vars {
 		query = fmt.Sprintf(`
 %s
-	%s: stackConfigAdd(
-		stack: "%s"
+	%s: %s(
+		%s: "%s"
 		config: {
 			id: "%s"
 			value: "%s"
@@ -49,12 +65,12 @@ func (c *Client) SetEnvVars(stack string, vars []EnvVar) error {
 	) {
 		id
 	}
-`, query, strings.ToLower(envVar.Key), stack, envVar.Key, envVar.Value, envVar.WriteOnly)
+`, query, strings.ToLower(envVar.Key), mutation, argument, id, envVar.Key, envVar.Value, envVar.WriteOnly)
 	}
 
 	query = query + "}"
 
-	response, err := c.querySpacelift(query)
+	response, err := c.querySpacelift(ctx, query)
 	if err != nil {
 		return err
 	}
@@ -63,7 +79,7 @@ func (c *Client) SetEnvVars(stack string, vars []EnvVar) error {
 	return nil
 }
 
-func (c *Client) RefreshJWT() error {
+func (c *Client) RefreshJWT(ctx context.Context) error {
 	jwtQuery := fmt.Sprintf(`
     mutation GetSpaceliftToken {
         apiKeyUser(id: "%s", secret: "%s") {
@@ -72,7 +88,7 @@ func (c *Client) RefreshJWT() error {
         }
       }`, c.APIKeyID, c.APIKeySecret)
 
-	tokenData, err := c.querySpacelift(jwtQuery)
+	tokenData, err := c.querySpacelift(ctx, jwtQuery)
 	if err != nil {
 		return err
 	}
@@ -100,14 +116,14 @@ func (c *Client) RefreshJWT() error {
 	return nil
 }
 
-func (c *Client) querySpacelift(query string) ([]byte, error) {
+func (c *Client) querySpacelift(ctx context.Context, query string) ([]byte, error) {
 	jsonData := map[string]string{
 		"query": query,
 	}
 	klog.V(10).Infof("spacelift query: %s", query)
 
 	jsonValue, _ := json.Marshal(jsonData)
-	request, err := http.NewRequest("POST", c.URL, bytes.NewBuffer(jsonValue))
+	request, err := http.NewRequestWithContext(ctx, "POST", c.URL, bytes.NewBuffer(jsonValue))
 	if err != nil {
 		return nil, err
 	}
@@ -117,7 +133,7 @@ func (c *Client) querySpacelift(query string) ([]byte, error) {
 	}
 
 	request.Header.Add("Content-Type", "application/json")
-	client := &http.Client{Timeout: time.Second * 10}
+	client := retry.NewClient(time.Second * 10)
 	response, err := client.Do(request)
 	if err != nil {
 		return nil, err
@@ -130,3 +146,136 @@ func (c *Client) querySpacelift(query string) ([]byte, error) {
 	}
 	return data, err
 }
+
+// CheckStack makes sure the stack exists and can be written to, without changing anything
+func (c *Client) CheckStack(ctx context.Context, stack string) error {
+	type Response struct {
+		Data struct {
+			Stack *struct {
+				ID       string `json:"id"`
+				CanWrite bool   `json:"canWrite"`
+			} `json:"stack"`
+		} `json:"data"`
+	}
+	response := Response{}
+	if err := c.check(ctx, fmt.Sprintf(`query { stack(id: "%s") { id canWrite } }`, stack), &response); err != nil {
+		return err
+	}
+	if response.Data.Stack == nil {
+		return fmt.Errorf("Spacelift stack %s does not exist", stack)
+	}
+	if !response.Data.Stack.CanWrite {
+		return fmt.Errorf("Spacelift API key is not allowed to write to stack %s", stack)
+	}
+	return nil
+}
+
+// CheckContext makes sure the context exists, without changing anything
+func (c *Client) CheckContext(ctx context.Context, contextID string) error {
+	type Response struct {
+		Data struct {
+			Context *struct {
+				ID string `json:"id"`
+			} `json:"context"`
+		} `json:"data"`
+	}
+	response := Response{}
+	if err := c.check(ctx, fmt.Sprintf(`query { context(id: "%s") { id } }`, contextID), &response); err != nil {
+		return err
+	}
+	if response.Data.Context == nil {
+		return fmt.Errorf("Spacelift context %s does not exist", contextID)
+	}
+	return nil
+}
+
+func (c *Client) check(ctx context.Context, query string, response interface{}) error {
+	if c.URL == "" || c.APIKeyID == "" || c.APIKeySecret == "" || c.jwt == "" {
+		return fmt.Errorf("spacelift client config is incomplete")
+	}
+	data, err := c.querySpacelift(ctx, query)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, response); err != nil {
+		return fmt.Errorf("could not parse Spacelift response: %s", err.Error())
+	}
+	return nil
+}
+
+// Stack is a Spacelift stack
+type Stack struct {
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	Labels       []string `json:"labels"`
+	SpaceDetails struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"spaceDetails"`
+}
+
+// FindStacks returns the stacks that have all of the given labels and are in one of
+// the given spaces. Spaces can be given by ID or name. Empty labels or spaces match
+// every stack.
+func (c *Client) FindStacks(ctx context.Context, labels, spaces []string) ([]Stack, error) {
+	if c.URL == "" || c.APIKeyID == "" || c.APIKeySecret == "" || c.jwt == "" {
+		return nil, fmt.Errorf("spacelift client config is incomplete")
+	}
+	query := `
+query {
+	stacks {
+		id
+		name
+		labels
+		spaceDetails {
+			id
+			name
+		}
+	}
+}`
+	data, err := c.querySpacelift(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	type Response struct {
+		Data struct {
+			Stacks []Stack `json:"stacks"`
+		} `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	response := Response{}
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, fmt.Errorf("could not parse Spacelift stacks: %s", err.Error())
+	}
+	if len(response.Errors) > 0 {
+		return nil, fmt.Errorf("error listing Spacelift stacks: %s", response.Errors[0].Message)
+	}
+
+	var stacks []Stack
+	for _, stack := range response.Data.Stacks {
+		if hasAllLabels(stack.Labels, labels) && inSpace(stack, spaces) {
+			stacks = append(stacks, stack)
+		}
+	}
+	klog.V(3).Infof("found %d Spacelift stacks with labels %v in spaces %v", len(stacks), labels, spaces)
+	return stacks, nil
+}
+
+func hasAllLabels(stackLabels, labels []string) bool {
+	for _, label := range labels {
+		if !slices.Contains(stackLabels, label) {
+			return false
+		}
+	}
+	return true
+}
+
+func inSpace(stack Stack, spaces []string) bool {
+	if len(spaces) == 0 {
+		return true
+	}
+	return slices.Contains(spaces, stack.SpaceDetails.ID) || slices.Contains(spaces, stack.SpaceDetails.Name)
+}
@@ -0,0 +1,102 @@
+package spacelift
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSpacelift hands out a JWT for any API key and lists a fixed set of stacks
+func fakeSpacelift(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Query string `json:"query"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	switch {
+	case strings.Contains(request.Query, "apiKeyUser"):
+		w.Write([]byte(`{"data": {"apiKeyUser": {"id": "key", "jwt": "spacelift-jwt"}}}`))
+	case r.Header.Get("Authorization") != "Bearer spacelift-jwt":
+		w.WriteHeader(http.StatusUnauthorized)
+	default:
+		w.Write([]byte(`{"data": {"stacks": [
+			{"id": "app-prod", "labels": ["vault", "prod"], "spaceDetails": {"id": "production-01H", "name": "production"}},
+			{"id": "app-dev", "labels": ["vault"], "spaceDetails": {"id": "dev-01H", "name": "dev"}},
+			{"id": "infra-prod", "labels": ["prod"], "spaceDetails": {"id": "production-01H", "name": "production"}},
+			{"id": "unlabeled", "labels": [], "spaceDetails": {"id": "root", "name": "root"}}
+		]}}`))
+	}
+}
+
+func TestFindStacks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(fakeSpacelift))
+	defer server.Close()
+	client := &Client{APIKeyID: "key", APIKeySecret: "secret", URL: server.URL}
+	assert.NoError(t, client.RefreshJWT(t.Context()))
+
+	tests := []struct {
+		name   string
+		labels []string
+		spaces []string
+		want   []string
+	}{
+		{
+			name:   "one label",
+			labels: []string{"vault"},
+			want:   []string{"app-prod", "app-dev"},
+		},
+		{
+			name:   "every label is required",
+			labels: []string{"vault", "prod"},
+			want:   []string{"app-prod"},
+		},
+		{
+			name:   "space by name",
+			spaces: []string{"production"},
+			want:   []string{"app-prod", "infra-prod"},
+		},
+		{
+			name:   "space by ID",
+			spaces: []string{"dev-01H"},
+			want:   []string{"app-dev"},
+		},
+		{
+			name:   "any of the spaces",
+			spaces: []string{"dev", "root"},
+			want:   []string{"app-dev", "unlabeled"},
+		},
+		{
+			name:   "labels and spaces",
+			labels: []string{"vault"},
+			spaces: []string{"production"},
+			want:   []string{"app-prod"},
+		},
+		{
+			name:   "no match",
+			labels: []string{"missing"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stacks, err := client.FindStacks(t.Context(), tt.labels, tt.spaces)
+			assert.NoError(t, err)
+			var ids []string
+			for _, stack := range stacks {
+				ids = append(ids, stack.ID)
+			}
+			assert.Equal(t, tt.want, ids)
+		})
+	}
+}
+
+func TestFindStacksWithoutJWT(t *testing.T) {
+	client := &Client{APIKeyID: "key", APIKeySecret: "secret", URL: "https://spacelift.example.com/graphql"}
+	_, err := client.FindStacks(t.Context(), []string{"vault"}, nil)
+	assert.EqualError(t, err, "spacelift client config is incomplete")
+}
@@ -0,0 +1,80 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStore keeps the records in a JSON file on the local filesystem
+type FileStore struct {
+	// Path is the file the records are kept in. It is created on the first update
+	Path string
+
+	lock sync.Mutex
+}
+
+// Load reads the records from the file. A missing file has no records
+func (s *FileStore) Load(ctx context.Context) (map[string]Record, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.load()
+}
+
+// Update applies fn to the record and writes every record back to the file
+func (s *FileStore) Update(ctx context.Context, id string, fn func(*Record)) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	records, err := s.load()
+	if err != nil {
+		return err
+	}
+	record := records[id]
+	fn(&record)
+	records[id] = record
+	return s.save(records)
+}
+
+func (s *FileStore) load() (map[string]Record, error) {
+	records := map[string]Record{}
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read state file: %s", err.Error())
+	}
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("could not parse state file %s: %s", s.Path, err.Error())
+	}
+	return records, nil
+}
+
+// save writes the records to a temporary file and renames it over the state file,
+// so that a crash mid-write never leaves a truncated file behind
+func (s *FileStore) save(records map[string]Record) error {
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".*")
+	if err != nil {
+		return fmt.Errorf("could not write state file: %s", err.Error())
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write state file: %s", err.Error())
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not write state file: %s", err.Error())
+	}
+	if err := os.Rename(tmp.Name(), s.Path); err != nil {
+		return fmt.Errorf("could not write state file: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/fairwindsops/vault-token-injector/pkg/kube"
+)
+
+// dataKey is the key the records are kept under in the ConfigMap or Secret
+const dataKey = "state.json"
+
+// DefaultName is the default name of the ConfigMap or Secret
+const DefaultName = "vault-token-injector-state"
+
+const (
+	// KindConfigMap keeps the records in a ConfigMap
+	KindConfigMap = "configmap"
+	// KindSecret keeps the records in a Secret
+	KindSecret = "secret"
+)
+
+// KubernetesStore keeps the records in a ConfigMap or Secret. Use a Secret if
+// token accessors should not be readable by everyone who can read ConfigMaps.
+type KubernetesStore struct {
+	// Kind is either KindConfigMap or KindSecret
+	Kind string
+	// Name is the name of the ConfigMap or Secret. It is created on the first update. Defaults to DefaultName
+	Name string
+	// Namespace is the namespace of the ConfigMap or Secret. Defaults to the namespace the pod is running in
+	Namespace string
+	// Client is the Kubernetes client. Defaults to kube.NewClient
+	Client kubernetes.Interface
+
+	// lock serializes updates from this process, which would otherwise conflict with each other
+	lock sync.Mutex
+}
+
+// Load reads the records from the ConfigMap or Secret. A missing object has no records
+func (s *KubernetesStore) Load(ctx context.Context) (map[string]Record, error) {
+	if err := s.setDefaults(); err != nil {
+		return nil, err
+	}
+	records, _, err := s.get(ctx)
+	return records, err
+}
+
+// Update applies fn to the record and writes every record back, retrying if the
+// object was changed by someone else in the meantime
+func (s *KubernetesStore) Update(ctx context.Context, id string, fn func(*Record)) error {
+	if err := s.setDefaults(); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		records, existing, err := s.get(ctx)
+		if err != nil {
+			return err
+		}
+		record := records[id]
+		fn(&record)
+		records[id] = record
+		data, err := json.Marshal(records)
+		if err != nil {
+			return err
+		}
+		return s.put(ctx, data, existing)
+	})
+}
+
+// get returns the records and the metadata of the object, which is nil if the
+// object does not exist
+func (s *KubernetesStore) get(ctx context.Context) (map[string]Record, *metav1.ObjectMeta, error) {
+	var data []byte
+	var meta metav1.ObjectMeta
+	var err error
+	switch s.Kind {
+	case KindConfigMap:
+		var configMap *corev1.ConfigMap
+		configMap, err = s.Client.CoreV1().ConfigMaps(s.Namespace).Get(ctx, s.Name, metav1.GetOptions{})
+		if err == nil {
+			data = []byte(configMap.Data[dataKey])
+			meta = configMap.ObjectMeta
+		}
+	case KindSecret:
+		var secret *corev1.Secret
+		secret, err = s.Client.CoreV1().Secrets(s.Namespace).Get(ctx, s.Name, metav1.GetOptions{})
+		if err == nil {
+			data = secret.Data[dataKey]
+			meta = secret.ObjectMeta
+		}
+	default:
+		return nil, nil, fmt.Errorf("unknown state kind %s", s.Kind)
+	}
+	records := map[string]Record{}
+	if apierrors.IsNotFound(err) {
+		return records, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read state from %s %s/%s: %s", s.Kind, s.Namespace, s.Name, err.Error())
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &records); err != nil {
+			return nil, nil, fmt.Errorf("could not parse state in %s %s/%s: %s", s.Kind, s.Namespace, s.Name, err.Error())
+		}
+	}
+	return records, &meta, nil
+}
+
+// put writes the data to the object, creating it if there is no existing object.
+// Updates conflict if the object changed since the existing metadata was read.
+func (s *KubernetesStore) put(ctx context.Context, data []byte, existing *metav1.ObjectMeta) error {
+	meta := metav1.ObjectMeta{
+		Name:      s.Name,
+		Namespace: s.Namespace,
+		Labels: map[string]string{
+			"app.kubernetes.io/managed-by": "vault-token-injector",
+		},
+	}
+	if existing != nil {
+		meta = *existing
+	}
+	var err error
+	switch s.Kind {
+	case KindConfigMap:
+		configMap := &corev1.ConfigMap{ObjectMeta: meta, Data: map[string]string{dataKey: string(data)}}
+		if existing == nil {
+			_, err = s.Client.CoreV1().ConfigMaps(s.Namespace).Create(ctx, configMap, metav1.CreateOptions{})
+		} else {
+			_, err = s.Client.CoreV1().ConfigMaps(s.Namespace).Update(ctx, configMap, metav1.UpdateOptions{})
+		}
+	case KindSecret:
+		secret := &corev1.Secret{ObjectMeta: meta, Data: map[string][]byte{dataKey: data}}
+		if existing == nil {
+			_, err = s.Client.CoreV1().Secrets(s.Namespace).Create(ctx, secret, metav1.CreateOptions{})
+		} else {
+			_, err = s.Client.CoreV1().Secrets(s.Namespace).Update(ctx, secret, metav1.UpdateOptions{})
+		}
+	}
+	if apierrors.IsAlreadyExists(err) {
+		// Someone else created it first, so read it again and retry
+		return apierrors.NewConflict(corev1.Resource(s.Kind), s.Name, err)
+	}
+	if err != nil && !apierrors.IsConflict(err) {
+		return fmt.Errorf("could not write state to %s %s/%s: %s", s.Kind, s.Namespace, s.Name, err.Error())
+	}
+	return err
+}
+
+func (s *KubernetesStore) setDefaults() error {
+	if s.Name == "" {
+		s.Name = DefaultName
+	}
+	if s.Namespace == "" {
+		s.Namespace = kube.Namespace()
+	}
+	if s.Client == nil {
+		client, err := kube.NewClient()
+		if err != nil {
+			return fmt.Errorf("could not set up state store: %s", err.Error())
+		}
+		s.Client = client
+	}
+	return nil
+}
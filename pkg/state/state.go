@@ -0,0 +1,43 @@
+package state
+
+import (
+	"context"
+	"time"
+)
+
+// Record is the injection history of a single target
+type Record struct {
+	// LastSuccess is when a token was last written to the target
+	LastSuccess time.Time `json:"last_success,omitzero"`
+	// LastError is the error from the last failed injection. It is cleared by a successful one
+	LastError string `json:"last_error,omitempty"`
+	// LastErrorTime is when the last failed injection happened
+	LastErrorTime time.Time `json:"last_error_time,omitzero"`
+	// Accessor is the accessor of the token that was last written to the target
+	Accessor string `json:"accessor,omitempty"`
+	// ExpiresAt is when the token that was last written to the target expires
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	// TokenSettings is a hash of the settings that token was created and written with
+	TokenSettings string `json:"token_settings,omitempty"`
+	// PendingRevocations are replaced tokens that are waiting out the grace period before they are revoked
+	PendingRevocations []Revocation `json:"pending_revocations,omitempty"`
+}
+
+// Revocation is a replaced token that is due to be revoked
+type Revocation struct {
+	// Accessor is the accessor of the token
+	Accessor string `json:"accessor"`
+	// After is when the token should be revoked
+	After time.Time `json:"after"`
+	// ExpiresAt is when the token expires, after which there is nothing left to revoke
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+}
+
+// Store persists the injection history of every target, by target ID
+type Store interface {
+	// Load returns the records of every target
+	Load(ctx context.Context) (map[string]Record, error)
+	// Update calls fn with the current record of the target, which is empty if
+	// there is none yet, and saves the result
+	Update(ctx context.Context, id string, fn func(*Record)) error
+}
@@ -0,0 +1,57 @@
+package state
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestStores(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	stores := map[string]Store{
+		"file":      &FileStore{Path: filepath.Join(t.TempDir(), "state.json")},
+		"configmap": &KubernetesStore{Kind: KindConfigMap, Namespace: "default", Client: fake.NewSimpleClientset()},
+		"secret":    &KubernetesStore{Kind: KindSecret, Namespace: "default", Client: fake.NewSimpleClientset()},
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			records, err := store.Load(ctx)
+			assert.NoError(t, err)
+			assert.Empty(t, records)
+
+			assert.NoError(t, store.Update(ctx, "circleci/org/repo", func(r *Record) {
+				r.LastSuccess = now
+				r.Accessor = "accessor-1"
+				r.ExpiresAt = now.Add(time.Hour)
+			}))
+			assert.NoError(t, store.Update(ctx, "tfcloud/ws-123", func(r *Record) {
+				r.LastError = "boom"
+				r.LastErrorTime = now
+			}))
+			// Updates only change the fields they set
+			assert.NoError(t, store.Update(ctx, "circleci/org/repo", func(r *Record) {
+				r.LastError = "later failure"
+			}))
+
+			records, err = store.Load(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, map[string]Record{
+				"circleci/org/repo": {
+					LastSuccess: now,
+					Accessor:    "accessor-1",
+					ExpiresAt:   now.Add(time.Hour),
+					LastError:   "later failure",
+				},
+				"tfcloud/ws-123": {
+					LastError:     "boom",
+					LastErrorTime: now,
+				},
+			}, records)
+		})
+	}
+}
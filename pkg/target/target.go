@@ -0,0 +1,115 @@
+package target
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Variable is a single environment variable that will be written to a target
+type Variable struct {
+	Key       string
+	Value     string
+	Sensitive bool
+}
+
+// TokenOptions describes how the vault token for a target should be created
+type TokenOptions struct {
+	// VaultRole is the vault role to use when creating the token
+	VaultRole *string
+	// VaultPolicies is a list of policies that will be given to the token
+	VaultPolicies []string
+	// TTL overrides the global token TTL when set
+	TTL time.Duration
+	// RefreshInterval overrides the global token refresh interval when set
+	RefreshInterval time.Duration
+	// TokenVariable overrides the global token variable name when set
+	TokenVariable string
+	// Orphan overrides the global orphan tokens setting when set
+	Orphan *bool
+}
+
+// Target is a single destination for a vault token, such as a CircleCI project,
+// a TFCloud workspace, or a Spacelift stack
+type Target interface {
+	// Provider returns the name of the provider that owns this target. It is used
+	// for logging and metrics.
+	Provider() string
+	// Name returns a human readable identifier for the target. It must be unique
+	// within the provider.
+	Name() string
+	// Validate returns an error if the target is not configured correctly
+	Validate() error
+	// TokenOptions returns the options used to create the vault token for this target
+	TokenOptions() TokenOptions
+	// SetVariables writes the given variables to the target. It should stop and
+	// return an error once the context is done. If it fails before writing any of
+	// the variables, it should return a NotWrittenError.
+	SetVariables(ctx context.Context, vars []Variable) error
+}
+
+// NotWrittenError is returned by SetVariables when none of the variables were
+// written. Any other error means that the token may be in the target.
+type NotWrittenError struct {
+	Err error
+}
+
+func (e *NotWrittenError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *NotWrittenError) Unwrap() error {
+	return e.Err
+}
+
+// Checker is implemented by targets that can check that they exist and can be
+// read without changing anything. Checks may also make sure that the target can
+// be written to, where the API can tell without a write. It is used by dry runs.
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// Provider produces the list of targets that should receive a vault token
+type Provider interface {
+	// Name returns the name of the provider, e.g. circleci
+	Name() string
+	// Targets returns the current list of targets for this provider. It is called
+	// once per injection cycle. It may return a partial list along with an error.
+	Targets(ctx context.Context) ([]Target, error)
+}
+
+// ID returns an identifier for the target that is unique across all providers
+func ID(t Target) string {
+	return fmt.Sprintf("%s/%s", t.Provider(), t.Name())
+}
+
+var (
+	registryLock sync.RWMutex
+	registry     = map[string]Provider{}
+)
+
+// Register adds a provider to the global registry. Registered providers are
+// injected alongside the built-in providers. Registering a provider with the
+// same name as an existing one replaces it, and a registered provider with the
+// same name as a built-in one, such as circleci, is used in its place.
+func Register(p Provider) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry[p.Name()] = p
+}
+
+// Registered returns all registered providers sorted by name
+func Registered() []Provider {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	providers := make([]Provider, 0, len(registry))
+	for _, p := range registry {
+		providers = append(providers, p)
+	}
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i].Name() < providers[j].Name()
+	})
+	return providers
+}
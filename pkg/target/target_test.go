@@ -0,0 +1,38 @@
+package target
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testProvider struct {
+	name    string
+	targets []Target
+}
+
+func (p testProvider) Name() string {
+	return p.name
+}
+
+func (p testProvider) Targets(ctx context.Context) ([]Target, error) {
+	return p.targets, nil
+}
+
+func TestRegister(t *testing.T) {
+	registry = map[string]Provider{}
+	defer func() {
+		registry = map[string]Provider{}
+	}()
+
+	Register(testProvider{name: "vercel"})
+	Register(testProvider{name: "circleci"})
+	replacement := testProvider{name: "vercel", targets: []Target{nil}}
+	Register(replacement)
+
+	providers := Registered()
+	assert.Len(t, providers, 2)
+	assert.Equal(t, "circleci", providers[0].Name())
+	assert.Equal(t, replacement, providers[1], "registering the same name again replaces the provider")
+}
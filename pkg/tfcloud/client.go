@@ -0,0 +1,74 @@
+package tfcloud
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	tfe "github.com/hashicorp/go-tfe"
+
+	"github.com/fairwindsops/vault-token-injector/pkg/retry"
+)
+
+// newClient creates a TFCloud client. If address is empty, app.terraform.io is used.
+// If caBundle is set, the PEM encoded certificates in that file are trusted in
+// addition to the system roots, for Terraform Enterprise with a private CA.
+// Requests are retried with the default retry policy rather than by go-tfe.
+func newClient(token, address, caBundle string) (*tfe.Client, error) {
+	base := http.DefaultTransport
+	if caBundle != "" {
+		transport, err := transportWithCABundle(caBundle)
+		if err != nil {
+			return nil, err
+		}
+		base = transport
+	}
+	config := &tfe.Config{
+		Address: address,
+		Token:   token,
+		HTTPClient: &http.Client{
+			Transport: rateLimitTransport{base: &retry.Transport{Base: base, Timeout: time.Second * 30}},
+		},
+		RetryServerErrors: false,
+	}
+	return tfe.NewClient(config)
+}
+
+// rateLimitTransport turns a 429 that the retry policy gave up on into an error.
+// go-tfe retries every 429 response up to 30 times on its own, but it does not
+// retry errors when RetryServerErrors is off.
+type rateLimitTransport struct {
+	base http.RoundTripper
+}
+
+func (t rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	response, err := t.base.RoundTrip(req)
+	if err != nil || response.StatusCode != http.StatusTooManyRequests {
+		return response, err
+	}
+	response.Body.Close()
+	return nil, fmt.Errorf("%s %s is still rate limited after retrying", req.Method, req.URL.Redacted())
+}
+
+func transportWithCABundle(caBundle string) (*http.Transport, error) {
+	pem, err := os.ReadFile(caBundle)
+	if err != nil {
+		return nil, fmt.Errorf("could not read TFCloud CA bundle: %s", err.Error())
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in TFCloud CA bundle %s", caBundle)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		RootCAs:    pool,
+		MinVersion: tls.VersionTLS12,
+	}
+	return transport, nil
+}
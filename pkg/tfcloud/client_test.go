@@ -0,0 +1,29 @@
+package tfcloud
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/fairwindsops/vault-token-injector/pkg/retry"
+)
+
+func TestNewClientRetries(t *testing.T) {
+	retry.SetDefaultPolicy(retry.Policy{MaxAttempts: 2, InitialBackoff: time.Millisecond})
+	t.Cleanup(func() { retry.SetDefaultPolicy(retry.BuiltinPolicy()) })
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	// The retry policy gives up, and go-tfe does not retry on top of it
+	_, err := newClient("tfe-token", server.URL, "")
+	assert.ErrorContains(t, err, "is still rate limited after retrying")
+	assert.Equal(t, int32(2), requests.Load())
+}
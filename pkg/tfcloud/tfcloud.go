@@ -2,6 +2,7 @@ package tfcloud
 
 import (
 	"context"
+	"fmt"
 
 	tfe "github.com/hashicorp/go-tfe"
 	"k8s.io/klog/v2"
@@ -14,21 +15,36 @@ type Variable struct {
 	Value               string
 	Token               string
 	Sensitive           bool
+	// Address is the TFCloud or Terraform Enterprise address. Defaults to app.terraform.io
+	Address string
+	// CABundle is an optional file of PEM encoded CA certificates to trust
+	CABundle string
 }
 
-// Update will update a variable in TFCloud.
-func (v Variable) Update() error {
-	klog.Infof("setting env var %s in TFCloud workspace %s", v.Key, v.WorkspaceIdentifier)
-	config := &tfe.Config{
-		Token: v.Token,
+// Check makes sure the workspace exists and that the token can update its variables,
+// without changing anything
+func (v Variable) Check(ctx context.Context) error {
+	client, err := newClient(v.Token, v.Address, v.CABundle)
+	if err != nil {
+		return err
+	}
+	workspace, err := client.Workspaces.ReadByID(ctx, v.Workspace)
+	if err != nil {
+		return fmt.Errorf("could not read TFCloud workspace %s: %w", v.WorkspaceIdentifier, err)
 	}
+	if workspace.Permissions != nil && !workspace.Permissions.CanUpdateVariable {
+		return fmt.Errorf("TFCloud token is not allowed to update variables in workspace %s", v.WorkspaceIdentifier)
+	}
+	return nil
+}
 
-	client, err := tfe.NewClient(config)
+// Update will update a variable in TFCloud.
+func (v Variable) Update(ctx context.Context) error {
+	klog.Infof("setting env var %s in TFCloud workspace %s", v.Key, v.WorkspaceIdentifier)
+	client, err := newClient(v.Token, v.Address, v.CABundle)
 	if err != nil {
 		return err
 	}
-	ctx := context.Background()
-
 	category := tfe.CategoryEnv
 	description := "Auto-Injected by vault-token-injector"
 
@@ -0,0 +1,230 @@
+package tfcloud
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	tfe "github.com/hashicorp/go-tfe"
+	"k8s.io/klog/v2"
+)
+
+// VariableSet is a variable set in a TFCloud organization
+type VariableSet struct {
+	Organization string
+	Name         string
+	Token        string
+	// Address is the TFCloud or Terraform Enterprise address. Defaults to app.terraform.io
+	Address string
+	// CABundle is an optional file of PEM encoded CA certificates to trust
+	CABundle string
+	// WorkspaceTags applies the variable set to every workspace that has all of these tags
+	WorkspaceTags []string
+	// ProjectTags applies the variable set to every project with these tag bindings,
+	// given as key or key=value
+	ProjectTags []string
+}
+
+// VariableSetVariable is an env variable in a variable set
+type VariableSetVariable struct {
+	Key       string
+	Value     string
+	Sensitive bool
+}
+
+// Update creates the variable set if it does not exist, sets the given variables in
+// it, and applies it to any workspaces and projects matching the configured tags.
+func (s VariableSet) Update(ctx context.Context, vars []VariableSetVariable) error {
+	klog.Infof("updating TFCloud variable set %s in organization %s", s.Name, s.Organization)
+	client, err := newClient(s.Token, s.Address, s.CABundle)
+	if err != nil {
+		return err
+	}
+	varset, err := s.findOrCreate(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	existing, err := listVariables(ctx, client, varset.ID)
+	if err != nil {
+		return err
+	}
+	category := tfe.CategoryEnv
+	description := "Auto-Injected by vault-token-injector"
+	for _, v := range vars {
+		var existingID string
+		for _, tfvar := range existing {
+			if tfvar.Key == v.Key {
+				existingID = tfvar.ID
+				break
+			}
+		}
+		if existingID != "" {
+			klog.Infof("var %s already exists in TFCloud variable set %s, updating instead", v.Key, s.Name)
+			_, err = client.VariableSetVariables.Update(ctx, varset.ID, existingID, &tfe.VariableSetVariableUpdateOptions{
+				Description: &description,
+				Sensitive:   &v.Sensitive,
+				Value:       &v.Value,
+			})
+		} else {
+			klog.Infof("setting env var %s in TFCloud variable set %s", v.Key, s.Name)
+			_, err = client.VariableSetVariables.Create(ctx, varset.ID, &tfe.VariableSetVariableCreateOptions{
+				Key:         &v.Key,
+				Value:       &v.Value,
+				Description: &description,
+				Sensitive:   &v.Sensitive,
+				Category:    &category,
+			})
+		}
+		if err != nil {
+			return fmt.Errorf("error setting %s: %w", v.Key, err)
+		}
+	}
+
+	if err := s.applyToWorkspaces(ctx, client, varset.ID); err != nil {
+		return err
+	}
+	return s.applyToProjects(ctx, client, varset.ID)
+}
+
+// listVariables returns every variable in the variable set
+func listVariables(ctx context.Context, client *tfe.Client, varsetID string) ([]*tfe.VariableSetVariable, error) {
+	options := &tfe.VariableSetVariableListOptions{
+		ListOptions: tfe.ListOptions{PageNumber: 1, PageSize: 100},
+	}
+	var variables []*tfe.VariableSetVariable
+	for {
+		list, err := client.VariableSetVariables.List(ctx, varsetID, options)
+		if err != nil {
+			return nil, err
+		}
+		variables = append(variables, list.Items...)
+		if list.Pagination == nil || list.NextPage == 0 {
+			break
+		}
+		options.PageNumber = list.NextPage
+	}
+	return variables, nil
+}
+
+func (s VariableSet) findOrCreate(ctx context.Context, client *tfe.Client) (*tfe.VariableSet, error) {
+	varset, err := s.find(ctx, client)
+	if err != nil || varset != nil {
+		return varset, err
+	}
+
+	klog.Infof("variable set %s does not exist in TFCloud organization %s, creating it", s.Name, s.Organization)
+	description := "Managed by vault-token-injector"
+	global := false
+	return client.VariableSets.Create(ctx, s.Organization, &tfe.VariableSetCreateOptions{
+		Name:        &s.Name,
+		Description: &description,
+		Global:      &global,
+	})
+}
+
+// Check makes sure the organization's variable sets can be read, without changing
+// anything. A variable set that does not exist yet is created on the first update.
+func (s VariableSet) Check(ctx context.Context) error {
+	client, err := newClient(s.Token, s.Address, s.CABundle)
+	if err != nil {
+		return err
+	}
+	varset, err := s.find(ctx, client)
+	if err != nil {
+		return fmt.Errorf("could not list variable sets in TFCloud organization %s: %w", s.Organization, err)
+	}
+	if varset == nil {
+		klog.Infof("variable set %s does not exist in TFCloud organization %s, it would be created", s.Name, s.Organization)
+	}
+	return nil
+}
+
+// find returns the variable set with the configured name, or nil if there is none
+func (s VariableSet) find(ctx context.Context, client *tfe.Client) (*tfe.VariableSet, error) {
+	options := &tfe.VariableSetListOptions{
+		ListOptions: tfe.ListOptions{PageNumber: 1, PageSize: 100},
+		Query:       s.Name,
+	}
+	for {
+		varsets, err := client.VariableSets.List(ctx, s.Organization, options)
+		if err != nil {
+			return nil, err
+		}
+		for _, varset := range varsets.Items {
+			if varset.Name == s.Name {
+				return varset, nil
+			}
+		}
+		if varsets.Pagination == nil || varsets.NextPage == 0 {
+			break
+		}
+		options.PageNumber = varsets.NextPage
+	}
+	return nil, nil
+}
+
+func (s VariableSet) applyToWorkspaces(ctx context.Context, client *tfe.Client, varsetID string) error {
+	if len(s.WorkspaceTags) == 0 {
+		return nil
+	}
+	options := &tfe.WorkspaceListOptions{
+		ListOptions: tfe.ListOptions{PageNumber: 1, PageSize: 100},
+		Tags:        strings.Join(s.WorkspaceTags, ","),
+	}
+	var workspaces []*tfe.Workspace
+	for {
+		list, err := client.Workspaces.List(ctx, s.Organization, options)
+		if err != nil {
+			return err
+		}
+		workspaces = append(workspaces, list.Items...)
+		if list.Pagination == nil || list.NextPage == 0 {
+			break
+		}
+		options.PageNumber = list.NextPage
+	}
+	if len(workspaces) == 0 {
+		klog.Warningf("no TFCloud workspaces found with tags %v for variable set %s", s.WorkspaceTags, s.Name)
+		return nil
+	}
+	klog.V(3).Infof("applying TFCloud variable set %s to %d workspaces", s.Name, len(workspaces))
+	return client.VariableSets.ApplyToWorkspaces(ctx, varsetID, &tfe.VariableSetApplyToWorkspacesOptions{
+		Workspaces: workspaces,
+	})
+}
+
+func (s VariableSet) applyToProjects(ctx context.Context, client *tfe.Client, varsetID string) error {
+	if len(s.ProjectTags) == 0 {
+		return nil
+	}
+	bindings := make([]*tfe.TagBinding, 0, len(s.ProjectTags))
+	for _, tag := range s.ProjectTags {
+		key, value, _ := strings.Cut(tag, "=")
+		bindings = append(bindings, &tfe.TagBinding{Key: key, Value: value})
+	}
+	options := &tfe.ProjectListOptions{
+		ListOptions: tfe.ListOptions{PageNumber: 1, PageSize: 100},
+		TagBindings: bindings,
+	}
+	var projects []*tfe.Project
+	for {
+		list, err := client.Projects.List(ctx, s.Organization, options)
+		if err != nil {
+			return err
+		}
+		projects = append(projects, list.Items...)
+		if list.Pagination == nil || list.NextPage == 0 {
+			break
+		}
+		options.PageNumber = list.NextPage
+	}
+	if len(projects) == 0 {
+		klog.Warningf("no TFCloud projects found with tags %v for variable set %s", s.ProjectTags, s.Name)
+		return nil
+	}
+	klog.V(3).Infof("applying TFCloud variable set %s to %d projects", s.Name, len(projects))
+	return client.VariableSets.ApplyToProjects(ctx, varsetID, tfe.VariableSetApplyToProjectsOptions{
+		Projects: projects,
+	})
+}
@@ -0,0 +1,269 @@
+package tfcloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeTFE serves variable sets and workspaces, honoring the requested page size
+type fakeTFE struct {
+	varsets    []*fakeVarset
+	workspaces []fakeWorkspace
+}
+
+type fakeVarset struct {
+	id         string
+	name       string
+	vars       []fakeVar
+	workspaces []string
+}
+
+type fakeVar struct {
+	id        string
+	key       string
+	value     string
+	sensitive bool
+}
+
+type fakeWorkspace struct {
+	id   string
+	name string
+	tags []string
+}
+
+type resource struct {
+	Type       string                 `json:"type"`
+	ID         string                 `json:"id"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+func (f *fakeTFE) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	path := strings.TrimPrefix(r.URL.Path, "/api/v2/")
+	if path == "ping" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	parts := strings.Split(path, "/")
+
+	switch {
+	case r.Method == http.MethodGet && path == "organizations/org/varsets":
+		var items []resource
+		for _, varset := range f.varsets {
+			if strings.Contains(varset.name, r.URL.Query().Get("q")) {
+				items = append(items, resource{Type: "varsets", ID: varset.id, Attributes: map[string]interface{}{"name": varset.name}})
+			}
+		}
+		writeList(w, r, items)
+	case r.Method == http.MethodPost && path == "organizations/org/varsets":
+		var body struct {
+			Data resource `json:"data"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		varset := &fakeVarset{id: fmt.Sprintf("varset-%d", len(f.varsets)+1), name: body.Data.Attributes["name"].(string)}
+		f.varsets = append(f.varsets, varset)
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, map[string]interface{}{"data": resource{Type: "varsets", ID: varset.id, Attributes: map[string]interface{}{"name": varset.name}}})
+	case len(parts) >= 4 && parts[0] == "varsets" && parts[2] == "relationships":
+		varset := f.varset(parts[1])
+		if varset == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		f.serveVarset(w, r, varset, parts[3:])
+	case r.Method == http.MethodGet && path == "organizations/org/workspaces":
+		var items []resource
+		for _, ws := range f.workspaces {
+			if matchesTags(ws.tags, r.URL.Query().Get("search[tags]")) {
+				items = append(items, resource{Type: "workspaces", ID: ws.id, Attributes: map[string]interface{}{"name": ws.name}})
+			}
+		}
+		writeList(w, r, items)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeTFE) serveVarset(w http.ResponseWriter, r *http.Request, varset *fakeVarset, parts []string) {
+	var body struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if r.Method != http.MethodGet {
+		_ = json.NewDecoder(r.Body).Decode(&body)
+	}
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 1 && parts[0] == "vars":
+		var items []resource
+		for _, v := range varset.vars {
+			items = append(items, v.resource())
+		}
+		writeList(w, r, items)
+	case r.Method == http.MethodPost && len(parts) == 1 && parts[0] == "vars":
+		var data resource
+		_ = json.Unmarshal(body.Data, &data)
+		v := fakeVar{
+			id:        fmt.Sprintf("var-new-%d", len(varset.vars)+1),
+			key:       data.Attributes["key"].(string),
+			value:     data.Attributes["value"].(string),
+			sensitive: data.Attributes["sensitive"].(bool),
+		}
+		varset.vars = append(varset.vars, v)
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, map[string]interface{}{"data": v.resource()})
+	case r.Method == http.MethodPatch && len(parts) == 2 && parts[0] == "vars":
+		var data resource
+		_ = json.Unmarshal(body.Data, &data)
+		for i, v := range varset.vars {
+			if v.id == parts[1] {
+				varset.vars[i].value = data.Attributes["value"].(string)
+				varset.vars[i].sensitive = data.Attributes["sensitive"].(bool)
+				writeJSON(w, map[string]interface{}{"data": varset.vars[i].resource()})
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	case r.Method == http.MethodPost && len(parts) == 1 && parts[0] == "workspaces":
+		var data []resource
+		_ = json.Unmarshal(body.Data, &data)
+		for _, ws := range data {
+			varset.workspaces = append(varset.workspaces, ws.ID)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeTFE) varset(id string) *fakeVarset {
+	for _, varset := range f.varsets {
+		if varset.id == id {
+			return varset
+		}
+	}
+	return nil
+}
+
+func (v fakeVar) resource() resource {
+	return resource{Type: "vars", ID: v.id, Attributes: map[string]interface{}{
+		"key":       v.key,
+		"value":     v.value,
+		"sensitive": v.sensitive,
+		"category":  "env",
+	}}
+}
+
+func matchesTags(tags []string, search string) bool {
+	if search == "" {
+		return true
+	}
+	for _, tag := range strings.Split(search, ",") {
+		found := false
+		for _, t := range tags {
+			found = found || t == tag
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// writeList writes the page of items asked for by the page[number] and page[size] query
+func writeList(w http.ResponseWriter, r *http.Request, items []resource) {
+	number, _ := strconv.Atoi(r.URL.Query().Get("page[number]"))
+	size, _ := strconv.Atoi(r.URL.Query().Get("page[size]"))
+	if number < 1 {
+		number = 1
+	}
+	if size < 1 {
+		size = 20
+	}
+	start := min((number-1)*size, len(items))
+	end := min(start+size, len(items))
+	next := 0
+	if end < len(items) {
+		next = number + 1
+	}
+	data := items[start:end]
+	if data == nil {
+		data = []resource{}
+	}
+	writeJSON(w, map[string]interface{}{
+		"data": data,
+		"meta": map[string]interface{}{"pagination": map[string]interface{}{
+			"current-page": number,
+			"next-page":    next,
+			"total-count":  len(items),
+			"total-pages":  (len(items) + size - 1) / size,
+		}},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func TestVariableSetUpdate(t *testing.T) {
+	fake := &fakeTFE{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	// More variables than fit on one page, with the token on the second page
+	existing := &fakeVarset{id: "varset-1", name: "vault"}
+	for i := 1; i <= 150; i++ {
+		existing.vars = append(existing.vars, fakeVar{id: fmt.Sprintf("var-%d", i), key: fmt.Sprintf("VAR_%d", i), value: "x"})
+	}
+	existing.vars[119].key = "VAULT_TOKEN"
+	fake.varsets = []*fakeVarset{existing}
+	fake.workspaces = []fakeWorkspace{
+		{id: "ws-1", name: "app", tags: []string{"vault", "prod"}},
+		{id: "ws-2", name: "other", tags: []string{"prod"}},
+	}
+
+	varset := VariableSet{
+		Organization:  "org",
+		Name:          "vault",
+		Token:         "tfe-token",
+		Address:       server.URL,
+		WorkspaceTags: []string{"vault", "prod"},
+	}
+	err := varset.Update(t.Context(), []VariableSetVariable{
+		{Key: "VAULT_TOKEN", Value: "hvs.1", Sensitive: true},
+		{Key: "VAULT_ADDR", Value: "https://vault"},
+	})
+	assert.NoError(t, err)
+
+	assert.Len(t, existing.vars, 151, "the token on the second page is updated rather than created again")
+	assert.Equal(t, fakeVar{id: "var-120", key: "VAULT_TOKEN", value: "hvs.1", sensitive: true}, existing.vars[119])
+	assert.Equal(t, fakeVar{id: "var-new-151", key: "VAULT_ADDR", value: "https://vault"}, existing.vars[150])
+	assert.Equal(t, []string{"ws-1"}, existing.workspaces)
+	assert.Len(t, fake.varsets, 1)
+}
+
+func TestVariableSetCreate(t *testing.T) {
+	fake := &fakeTFE{varsets: []*fakeVarset{{id: "varset-1", name: "vault-staging"}}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	varset := VariableSet{Organization: "org", Name: "vault", Token: "tfe-token", Address: server.URL}
+
+	// Check does not create the variable set
+	assert.NoError(t, varset.Check(t.Context()))
+	assert.Len(t, fake.varsets, 1)
+
+	assert.NoError(t, varset.Update(t.Context(), []VariableSetVariable{{Key: "VAULT_TOKEN", Value: "hvs.1", Sensitive: true}}))
+	assert.Len(t, fake.varsets, 2, "a variable set with a name that only contains the configured name is not used")
+	created := fake.varsets[1]
+	assert.Equal(t, "vault", created.name)
+	assert.Equal(t, []fakeVar{{id: "var-new-1", key: "VAULT_TOKEN", value: "hvs.1", sensitive: true}}, created.vars)
+
+	// The next update finds the variable set it created
+	assert.NoError(t, varset.Update(t.Context(), []VariableSetVariable{{Key: "VAULT_TOKEN", Value: "hvs.2", Sensitive: true}}))
+	assert.Len(t, fake.varsets, 2)
+	assert.Equal(t, []fakeVar{{id: "var-new-1", key: "VAULT_TOKEN", value: "hvs.2", sensitive: true}}, created.vars)
+}
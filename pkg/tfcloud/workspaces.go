@@ -0,0 +1,101 @@
+package tfcloud
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	tfe "github.com/hashicorp/go-tfe"
+	"k8s.io/klog/v2"
+)
+
+// WorkspaceSelector selects the workspaces in an organization that match all of the
+// given tags, project, and name regex
+type WorkspaceSelector struct {
+	Organization string
+	Token        string
+	// Address is the TFCloud or Terraform Enterprise address. Defaults to app.terraform.io
+	Address string
+	// CABundle is an optional file of PEM encoded CA certificates to trust
+	CABundle string
+	// Tags selects workspaces that have all of these tags
+	Tags []string
+	// Project selects workspaces in the project with this name
+	Project string
+	// NameRegex selects workspaces with a name matching this regular expression
+	NameRegex string
+}
+
+// Workspace is a workspace found by a WorkspaceSelector
+type Workspace struct {
+	ID   string
+	Name string
+}
+
+// List returns all workspaces matching the selector
+func (s WorkspaceSelector) List(ctx context.Context) ([]Workspace, error) {
+	if len(s.Tags) == 0 && s.Project == "" && s.NameRegex == "" {
+		return nil, fmt.Errorf("workspace selector for organization %s has no tags, project, or name regex", s.Organization)
+	}
+	var nameRegex *regexp.Regexp
+	if s.NameRegex != "" {
+		var err error
+		nameRegex, err = regexp.Compile(s.NameRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid workspace name regex: %s", err.Error())
+		}
+	}
+
+	client, err := newClient(s.Token, s.Address, s.CABundle)
+	if err != nil {
+		return nil, err
+	}
+	options := &tfe.WorkspaceListOptions{
+		ListOptions: tfe.ListOptions{PageNumber: 1, PageSize: 100},
+		Tags:        strings.Join(s.Tags, ","),
+	}
+	if s.Project != "" {
+		projectID, err := s.projectID(ctx, client)
+		if err != nil {
+			return nil, err
+		}
+		options.ProjectID = projectID
+	}
+
+	var workspaces []Workspace
+	for {
+		list, err := client.Workspaces.List(ctx, s.Organization, options)
+		if err != nil {
+			return nil, err
+		}
+		for _, ws := range list.Items {
+			if nameRegex != nil && !nameRegex.MatchString(ws.Name) {
+				continue
+			}
+			workspaces = append(workspaces, Workspace{ID: ws.ID, Name: ws.Name})
+		}
+		if list.Pagination == nil || list.NextPage == 0 {
+			break
+		}
+		options.PageNumber = list.NextPage
+	}
+	klog.V(3).Infof("found %d TFCloud workspaces in organization %s", len(workspaces), s.Organization)
+	return workspaces, nil
+}
+
+func (s WorkspaceSelector) projectID(ctx context.Context, client *tfe.Client) (string, error) {
+	projects, err := client.Projects.List(ctx, s.Organization, &tfe.ProjectListOptions{
+		ListOptions: tfe.ListOptions{PageNumber: 1, PageSize: 100},
+		Name:        s.Project,
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, project := range projects.Items {
+		if project.Name == s.Project {
+			return project.ID, nil
+		}
+	}
+	return "", fmt.Errorf("could not find TFCloud project %s in organization %s", s.Project, s.Organization)
+}
@@ -0,0 +1,106 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// DefaultKubernetesJWTFile is the location of the service account token in a pod
+const DefaultKubernetesJWTFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// AuthMethod logs in to vault to obtain a token for the injector itself
+type AuthMethod interface {
+	// Login authenticates against vault and returns the resulting secret
+	Login(ctx context.Context, client *api.Client) (*api.Secret, error)
+}
+
+// KubernetesAuth logs in to vault using a Kubernetes service account JWT
+type KubernetesAuth struct {
+	// Mount is the path the kubernetes auth method is mounted at. Defaults to kubernetes
+	Mount string
+	// Role is the vault role to log in as
+	Role string
+	// JWTFile is the path to the service account token. Defaults to DefaultKubernetesJWTFile
+	JWTFile string
+}
+
+// Login reads the service account token and exchanges it for a vault token. The
+// token file is read on every login so that rotated projected tokens are picked up.
+func (k KubernetesAuth) Login(ctx context.Context, client *api.Client) (*api.Secret, error) {
+	if k.Role == "" {
+		return nil, fmt.Errorf("kubernetes auth requires a role")
+	}
+	mount := k.Mount
+	if mount == "" {
+		mount = "kubernetes"
+	}
+	jwtFile := k.JWTFile
+	if jwtFile == "" {
+		jwtFile = DefaultKubernetesJWTFile
+	}
+	jwt, err := os.ReadFile(jwtFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read service account token: %s", err.Error())
+	}
+
+	path := fmt.Sprintf("auth/%s/login", strings.Trim(mount, "/"))
+	return client.Logical().WriteWithContext(ctx, path, map[string]interface{}{
+		"role": k.Role,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	})
+}
+
+// AppRoleAuth logs in to vault using an AppRole role_id and secret_id
+type AppRoleAuth struct {
+	// Mount is the path the approle auth method is mounted at. Defaults to approle
+	Mount string
+	// RoleIDFile is a file containing the role_id. If empty, VAULT_ROLE_ID is used
+	RoleIDFile string
+	// SecretIDFile is a file containing the secret_id. If empty, VAULT_SECRET_ID is used
+	SecretIDFile string
+}
+
+// Login reads the role_id and secret_id and exchanges them for a vault token. The
+// files are read on every login so that a rotated secret_id is picked up.
+func (a AppRoleAuth) Login(ctx context.Context, client *api.Client) (*api.Secret, error) {
+	mount := a.Mount
+	if mount == "" {
+		mount = "approle"
+	}
+	roleID, err := readFileOrEnv(a.RoleIDFile, "VAULT_ROLE_ID")
+	if err != nil {
+		return nil, fmt.Errorf("could not read approle role_id: %s", err.Error())
+	}
+	secretID, err := readFileOrEnv(a.SecretIDFile, "VAULT_SECRET_ID")
+	if err != nil {
+		return nil, fmt.Errorf("could not read approle secret_id: %s", err.Error())
+	}
+
+	path := fmt.Sprintf("auth/%s/login", strings.Trim(mount, "/"))
+	return client.Logical().WriteWithContext(ctx, path, map[string]interface{}{
+		"role_id":   roleID,
+		"secret_id": secretID,
+	})
+}
+
+// readFileOrEnv returns the trimmed contents of file, or the value of env if file is empty
+func readFileOrEnv(file, env string) (string, error) {
+	var value string
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		value = strings.TrimSpace(string(data))
+	} else {
+		value = os.Getenv(env)
+	}
+	if value == "" {
+		return "", fmt.Errorf("no value found in file or %s", env)
+	}
+	return value, nil
+}
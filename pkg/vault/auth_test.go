@@ -0,0 +1,170 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeVaultAuth records logins and hands out numbered tokens
+type fakeVaultAuth struct {
+	lock   sync.Mutex
+	logins []fakeLogin
+}
+
+type fakeLogin struct {
+	path string
+	body map[string]string
+}
+
+func (f *fakeVaultAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	body := map[string]string{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.logins = append(f.logins, fakeLogin{path: r.URL.Path, body: body})
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"auth": {"client_token": "token-%d", "lease_duration": 3600}}`, len(f.logins))
+}
+
+func writeFile(t *testing.T, dir, name, contents string) string {
+	path := filepath.Join(dir, name)
+	assert.NoError(t, os.WriteFile(path, []byte(contents), 0600))
+	return path
+}
+
+func TestKubernetesAuth(t *testing.T) {
+	jwtFile := writeFile(t, t.TempDir(), "token", "service-account-jwt\n")
+
+	tests := []struct {
+		name     string
+		auth     KubernetesAuth
+		wantPath string
+		wantErr  string
+	}{
+		{
+			name:     "default mount",
+			auth:     KubernetesAuth{Role: "injector", JWTFile: jwtFile},
+			wantPath: "/v1/auth/kubernetes/login",
+		},
+		{
+			name:     "custom mount",
+			auth:     KubernetesAuth{Mount: "/k8s/prod/", Role: "injector", JWTFile: jwtFile},
+			wantPath: "/v1/auth/k8s/prod/login",
+		},
+		{
+			name:    "no role",
+			auth:    KubernetesAuth{JWTFile: jwtFile},
+			wantErr: "error logging in to vault: kubernetes auth requires a role",
+		},
+		{
+			name:    "missing token file",
+			auth:    KubernetesAuth{Role: "injector", JWTFile: filepath.Join(t.TempDir(), "missing")},
+			wantErr: "could not read service account token",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeVaultAuth{}
+			server := httptest.NewServer(fake)
+			defer server.Close()
+			client, err := NewClientWithAuth(context.Background(), server.URL, tt.auth)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				assert.Empty(t, fake.logins)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, []fakeLogin{{
+				path: tt.wantPath,
+				body: map[string]string{"role": "injector", "jwt": "service-account-jwt"},
+			}}, fake.logins)
+			assert.Equal(t, "token-1", client.client.Token())
+			assert.Equal(t, time.Hour, client.leaseTTL)
+		})
+	}
+}
+
+func TestLoginIfExpiring(t *testing.T) {
+	jwtFile := writeFile(t, t.TempDir(), "token", "service-account-jwt")
+	fake := &fakeVaultAuth{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client, err := NewClientWithAuth(context.Background(), server.URL, KubernetesAuth{Role: "injector", JWTFile: jwtFile})
+	assert.NoError(t, err)
+
+	// More than a third of the lease remains
+	client.expiresAt = time.Now().Add(client.leaseTTL / 2)
+	assert.NoError(t, client.LoginIfExpiring(context.Background()))
+	assert.Len(t, fake.logins, 1)
+	assert.Equal(t, "token-1", client.client.Token())
+
+	// Less than a third of the lease remains
+	client.expiresAt = time.Now().Add(client.leaseTTL / 4)
+	assert.NoError(t, client.LoginIfExpiring(context.Background()))
+	assert.Len(t, fake.logins, 2)
+	assert.Equal(t, "token-2", client.client.Token())
+	assert.WithinDuration(t, time.Now().Add(time.Hour), client.expiresAt, time.Minute)
+
+	// Clients with a static token never log in
+	static, err := NewClient(server.URL, "static-token")
+	assert.NoError(t, err)
+	assert.NoError(t, static.LoginIfExpiring(context.Background()))
+	assert.Len(t, fake.logins, 2)
+	assert.Equal(t, "static-token", static.client.Token())
+}
+
+func TestAppRoleAuth(t *testing.T) {
+	dir := t.TempDir()
+	roleIDFile := writeFile(t, dir, "role-id", "role\n")
+	secretIDFile := writeFile(t, dir, "secret-id", "secret-1\n")
+	fake := &fakeVaultAuth{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	client, err := NewClientWithAuth(context.Background(), server.URL, AppRoleAuth{
+		Mount:        "approle-ci",
+		RoleIDFile:   roleIDFile,
+		SecretIDFile: secretIDFile,
+	})
+	assert.NoError(t, err)
+
+	// A rotated secret_id is picked up on the next login
+	writeFile(t, dir, "secret-id", "secret-2\n")
+	assert.NoError(t, client.Login(context.Background()))
+	assert.Equal(t, []fakeLogin{
+		{path: "/v1/auth/approle-ci/login", body: map[string]string{"role_id": "role", "secret_id": "secret-1"}},
+		{path: "/v1/auth/approle-ci/login", body: map[string]string{"role_id": "role", "secret_id": "secret-2"}},
+	}, fake.logins)
+	assert.Equal(t, "token-2", client.client.Token())
+
+	// The environment is used when no files are set
+	t.Setenv("VAULT_ROLE_ID", "env-role")
+	t.Setenv("VAULT_SECRET_ID", "env-secret")
+	_, err = NewClientWithAuth(context.Background(), server.URL, AppRoleAuth{})
+	assert.NoError(t, err)
+	assert.Equal(t, fakeLogin{
+		path: "/v1/auth/approle/login",
+		body: map[string]string{"role_id": "env-role", "secret_id": "env-secret"},
+	}, fake.logins[2])
+
+	// A missing secret_id file fails the login
+	assert.NoError(t, os.Remove(secretIDFile))
+	assert.ErrorContains(t, client.Login(context.Background()), "could not read approle secret_id")
+}
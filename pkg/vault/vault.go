@@ -1,21 +1,31 @@
 package vault
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/vault/api"
 	"k8s.io/klog/v2"
+
+	"github.com/fairwindsops/vault-token-injector/pkg/retry"
 )
 
 type Client struct {
 	client *api.Client
+
+	// auth is set when the client logs in with an auth method instead of a static token
+	auth      AuthMethod
+	authLock  sync.Mutex
+	leaseTTL  time.Duration
+	expiresAt time.Time
 }
 
 func NewClient(address string, token string) (*Client, error) {
-	config := api.DefaultConfig()
-	config.Address = address
-	client, err := api.NewClient(config)
+	client, err := newAPIClient(address)
 	if err != nil {
 		return nil, err
 	}
@@ -28,8 +38,79 @@ func NewClient(address string, token string) (*Client, error) {
 	return &Client{client: client}, nil
 }
 
-func (c Client) LookupSelf() error {
-	info, err := c.client.Auth().Token().LookupSelf()
+// NewClientWithAuth creates a client that logs in using the given auth method
+// and logs in again whenever the token nears expiry
+func NewClientWithAuth(ctx context.Context, address string, auth AuthMethod) (*Client, error) {
+	client, err := newAPIClient(address)
+	if err != nil {
+		return nil, err
+	}
+	// Don't pick up VAULT_TOKEN from the environment, the auth method provides the token
+	client.ClearToken()
+	c := &Client{client: client, auth: auth}
+	if err := c.Login(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func newAPIClient(address string) (*api.Client, error) {
+	config := api.DefaultConfig()
+	config.Address = address
+	// Retries are done by the callers with the retry package, so that attempts are
+	// not multiplied and token creation is only retried when it is safe to
+	config.MaxRetries = 0
+	return api.NewClient(config)
+}
+
+// Login authenticates with the configured auth method and replaces the current token
+func (c *Client) Login(ctx context.Context) error {
+	if c.auth == nil {
+		return fmt.Errorf("no vault auth method configured")
+	}
+	c.authLock.Lock()
+	defer c.authLock.Unlock()
+	return c.login(ctx)
+}
+
+func (c *Client) login(ctx context.Context) error {
+	secret, err := c.auth.Login(ctx, c.client)
+	if err != nil {
+		return fmt.Errorf("error logging in to vault: %s", err.Error())
+	}
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return fmt.Errorf("error logging in to vault: no token was returned")
+	}
+	c.client.SetToken(secret.Auth.ClientToken)
+	c.leaseTTL = time.Duration(secret.Auth.LeaseDuration) * time.Second
+	c.expiresAt = time.Now().Add(c.leaseTTL)
+	klog.V(3).Infof("logged in to vault, token expires at %s", c.expiresAt.String())
+	return nil
+}
+
+// LoginIfExpiring logs in again if less than a third of the token lease remains.
+// Clients created with a static token are left untouched.
+func (c *Client) LoginIfExpiring(ctx context.Context) error {
+	if c.auth == nil {
+		return nil
+	}
+	c.authLock.Lock()
+	defer c.authLock.Unlock()
+	// A lease duration of zero means the token does not expire
+	if c.leaseTTL == 0 || time.Until(c.expiresAt) > c.leaseTTL/3 {
+		return nil
+	}
+	klog.V(3).Infof("vault token expires at %s, logging in again", c.expiresAt.String())
+	return c.login(ctx)
+}
+
+func (c *Client) LookupSelf(ctx context.Context) error {
+	var info *api.Secret
+	err := retry.DefaultPolicy().DoContext(ctx, func() error {
+		var err error
+		info, err = c.client.Auth().Token().LookupSelfWithContext(ctx)
+		return retryableError(err)
+	})
 	if err != nil {
 		return fmt.Errorf("error looking up self: %s", err.Error())
 	}
@@ -38,31 +119,27 @@ func (c Client) LookupSelf() error {
 
 }
 
-func (c Client) CreateToken(role *string, policies []string, ttl time.Duration, orphan bool) (*Token, error) {
+func (c *Client) CreateToken(ctx context.Context, role *string, policies []string, ttl time.Duration, orphan bool) (*Token, error) {
 	tokenRequest := &api.TokenCreateRequest{
 		TTL: ttl.String(),
 	}
 
 	var resp *api.Secret
-	var err error
-
-	if role != nil {
-		resp, err = c.client.Auth().Token().CreateWithRole(tokenRequest, *role)
-		if err != nil {
-			return nil, err
-		}
-	} else if orphan {
-		tokenRequest.Policies = policies
-		resp, err = c.client.Auth().Token().CreateOrphan(tokenRequest)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		tokenRequest.Policies = policies
-		resp, err = c.client.Auth().Token().Create(tokenRequest)
-		if err != nil {
-			return nil, err
+	err := retry.DefaultPolicy().DoContext(ctx, func() error {
+		var err error
+		if role != nil {
+			resp, err = c.client.Auth().Token().CreateWithRoleWithContext(ctx, tokenRequest, *role)
+		} else if orphan {
+			tokenRequest.Policies = policies
+			resp, err = c.client.Auth().Token().CreateOrphanWithContext(ctx, tokenRequest)
+		} else {
+			tokenRequest.Policies = policies
+			resp, err = c.client.Auth().Token().CreateWithContext(ctx, tokenRequest)
 		}
+		return retryableCreateError(err)
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	tokenTTL, err := resp.TokenTTL()
@@ -76,10 +153,53 @@ func (c Client) CreateToken(role *string, policies []string, ttl time.Duration,
 	if err != nil {
 		return nil, err
 	}
+	token.Auth.Accessor, err = resp.TokenAccessor()
+	if err != nil {
+		return nil, err
+	}
 
 	return token, nil
 }
 
+// retryableError marks network errors and 429 or 5xx responses from vault as retryable
+func retryableError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var responseErr *api.ResponseError
+	if errors.As(err, &responseErr) {
+		if responseErr.StatusCode == http.StatusTooManyRequests || responseErr.StatusCode >= http.StatusInternalServerError {
+			return retry.Retryable(err)
+		}
+		return err
+	}
+	return retry.Retryable(err)
+}
+
+// retryableCreateError marks errors from creating a token as retryable only when
+// vault rejected the request without creating one, which is a 429 from a rate limit
+// quota or a 503 from a sealed or unavailable vault. Network errors and other 5xx
+// responses are not retried, since vault may have created a token that nothing
+// would then track or revoke.
+func retryableCreateError(err error) error {
+	var responseErr *api.ResponseError
+	if errors.As(err, &responseErr) && (responseErr.StatusCode == http.StatusTooManyRequests || responseErr.StatusCode == http.StatusServiceUnavailable) {
+		return retry.Retryable(err)
+	}
+	return err
+}
+
+// RevokeAccessor revokes the token with the given accessor
+func (c *Client) RevokeAccessor(ctx context.Context, accessor string) error {
+	err := retry.DefaultPolicy().DoContext(ctx, func() error {
+		return retryableError(c.client.Auth().Token().RevokeAccessorWithContext(ctx, accessor))
+	})
+	if err != nil {
+		return fmt.Errorf("error revoking token by accessor: %s", err.Error())
+	}
+	return nil
+}
+
 // Token represents a token structure in Vault
 type Token struct {
 	Data struct {
@@ -87,5 +207,6 @@ type Token struct {
 	} `json:"data"`
 	Auth struct {
 		ClientToken string `json:"client_token"`
+		Accessor    string `json:"accessor"`
 	} `json:"auth"`
 }
@@ -0,0 +1,104 @@
+package vault
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/fairwindsops/vault-token-injector/pkg/retry"
+)
+
+func TestCreateTokenRetries(t *testing.T) {
+	retry.SetDefaultPolicy(retry.Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond})
+	t.Cleanup(func() { retry.SetDefaultPolicy(retry.Policy{}) })
+
+	tests := []struct {
+		name     string
+		statuses []int
+		wantErr  bool
+		attempts int
+	}{
+		{
+			name:     "rate limited",
+			statuses: []int{http.StatusTooManyRequests, http.StatusOK},
+			attempts: 2,
+		},
+		{
+			name:     "sealed",
+			statuses: []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+			wantErr:  true,
+			attempts: 3,
+		},
+		{
+			name:     "gateway timeout may have created a token",
+			statuses: []int{http.StatusGatewayTimeout, http.StatusOK},
+			wantErr:  true,
+			attempts: 1,
+		},
+		{
+			name:     "internal error",
+			statuses: []int{http.StatusInternalServerError, http.StatusOK},
+			wantErr:  true,
+			attempts: 1,
+		},
+		{
+			name:     "permission denied",
+			statuses: []int{http.StatusForbidden},
+			wantErr:  true,
+			attempts: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				status := tt.statuses[attempts.Add(1)-1]
+				w.WriteHeader(status)
+				if status == http.StatusOK {
+					w.Write([]byte(`{"auth": {"client_token": "hvs.1", "accessor": "accessor-1", "lease_duration": 3600}}`))
+				}
+			}))
+			t.Cleanup(server.Close)
+			client, err := NewClient(server.URL, "injector-token")
+			assert.NoError(t, err)
+
+			token, err := client.CreateToken(t.Context(), nil, []string{"ci"}, time.Hour, false)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, "hvs.1", token.Auth.ClientToken)
+			}
+			assert.Equal(t, int32(tt.attempts), attempts.Load(), "vault's own retries are disabled")
+		})
+	}
+}
+
+func TestCreateTokenNetworkError(t *testing.T) {
+	retry.SetDefaultPolicy(retry.Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond})
+	t.Cleanup(func() { retry.SetDefaultPolicy(retry.Policy{}) })
+
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		// Drop the connection after vault would have created the token
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	t.Cleanup(server.Close)
+	client, err := NewClient(server.URL, "injector-token")
+	assert.NoError(t, err)
+
+	_, err = client.CreateToken(t.Context(), nil, []string{"ci"}, time.Hour, false)
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), attempts.Load())
+
+	// Revoking is safe to repeat, so it is retried
+	attempts.Store(0)
+	assert.Error(t, client.RevokeAccessor(t.Context(), "accessor-1"))
+	assert.Equal(t, int32(3), attempts.Load())
+}